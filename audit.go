@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"expvar"
+	"regexp"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+var METRIC_AUDIT_DROPPED = expvar.NewInt("audit_dropped")
+
+// the audit db of -audit-db, nil when not set
+var AUDIT *auditLog
+
+var AUDIT_BATCH = 100
+var AUDIT_FLUSH = time.Second
+
+var RE_REQUEST_LINE = regexp.MustCompile(`^([A-Z]+) (\S+) HTTP/1\.[01]\r\n`)
+var RE_STATUS_LINE = regexp.MustCompile(`^HTTP/1\.[01] ([0-9]{3})`)
+
+const AUDIT_SCHEMA = `CREATE TABLE IF NOT EXISTS requests (
+	ts INTEGER NOT NULL,
+	client TEXT NOT NULL,
+	method TEXT NOT NULL,
+	host TEXT NOT NULL,
+	port TEXT NOT NULL,
+	path TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	bytes_up INTEGER NOT NULL,
+	bytes_down INTEGER NOT NULL,
+	duration REAL NOT NULL,
+	route TEXT NOT NULL
+)`
+
+const AUDIT_INSERT = `INSERT INTO requests
+	(ts, client, method, host, port, path, status, bytes_up, bytes_down, duration, route)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// auditRow is a row of the requests table: a plain HTTP request, or a
+// CONNECT or SOCKS tunnel, coarse with no path and status. up and down
+// are the bytes that went through the connection before the request.
+type auditRow struct {
+	started time.Time
+	event   WebhookEvent
+	method  string
+	path    string
+	status  int
+	up      int64
+	down    int64
+}
+
+type auditLog struct {
+	db    *sql.DB
+	queue chan auditRow
+	done  chan bool
+}
+
+// openAudit opens (or creates) the SQLite db at path and starts the
+// writer, which inserts the rows in batches.
+func openAudit(path string) (*auditLog, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(AUDIT_SCHEMA)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	a := &auditLog{db, make(chan auditRow, 1024), make(chan bool)}
+	go a.run()
+	return a, nil
+}
+
+// newAuditRow starts the row of a relay. d2r is the request sent ahead
+// to the remote; a plain HTTP request there gives the method and path.
+func newAuditRow(d2r []byte, socks bool) *auditRow {
+	row := &auditRow{started: time.Now(), method: "CONNECT"}
+	if socks {
+		row.method = "SOCKS"
+	}
+	if m := RE_REQUEST_LINE.FindSubmatch(d2r); m != nil {
+		row.method = string(m[1])
+		row.path = string(m[2])
+	}
+	return row
+}
+
+// next starts the row of the following request of a keep-alive HTTP
+// connection when data, read from the client, begins with a request line,
+// and returns nil otherwise. ev has the counts of the connection so far.
+// A pipelined request that does not begin a read is not seen.
+func (row *auditRow) next(data []byte, ev WebhookEvent) *auditRow {
+	if row.path == "" {
+		return nil
+	}
+	line := data
+	if i := bytes.Index(data, []byte("\r\n")); i >= 0 {
+		line = data[:i+2]
+	}
+	m := RE_REQUEST_LINE.FindSubmatch(rewriteRequestLine(line))
+	if m == nil {
+		return nil
+	}
+	return &auditRow{started: time.Now(), method: string(m[1]), path: string(m[2]),
+		up: ev.BytesUp, down: ev.BytesDown}
+}
+
+// finish returns the row with the counts of its request, from the event
+// ev of the connection.
+func (row *auditRow) finish(ev WebhookEvent) auditRow {
+	ev.BytesUp -= row.up
+	ev.BytesDown -= row.down
+	ev.Duration = time.Since(row.started).Seconds()
+	done := *row
+	done.event = ev
+	return done
+}
+
+// response takes the status from the first response to the request,
+// skipping interim ones.
+func (row *auditRow) response(data []byte) {
+	if row.status != 0 || row.path == "" || bytes.HasPrefix(data, []byte("HTTP/1.1 1")) {
+		return
+	}
+	if m := RE_STATUS_LINE.FindSubmatch(data); m != nil {
+		row.status, _ = strconv.Atoi(string(m[1]))
+	}
+}
+
+// add queues row for the writer. It never blocks the relay: when the
+// queue is full because the disk is slow, the row is dropped.
+func (a *auditLog) add(row auditRow) {
+	select {
+	case a.queue <- row:
+	default:
+		METRIC_AUDIT_DROPPED.Add(1)
+		debug("audit queue full, drop row for %s:%s", row.event.Host, row.event.Port)
+	}
+}
+
+func (a *auditLog) run() {
+	rows := []auditRow{}
+	ticker := time.NewTicker(AUDIT_FLUSH)
+	defer ticker.Stop()
+	for {
+		select {
+		case row, ok := <-a.queue:
+			if !ok {
+				a.insert(rows)
+				a.db.Close()
+				close(a.done)
+				return
+			}
+			rows = append(rows, row)
+			if len(rows) < AUDIT_BATCH {
+				continue
+			}
+		case <-ticker.C:
+		}
+		a.insert(rows)
+		rows = rows[:0]
+	}
+}
+
+func (a *auditLog) insert(rows []auditRow) {
+	if len(rows) == 0 {
+		return
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		warn("audit: %v", err)
+		return
+	}
+	stmt, err := tx.Prepare(AUDIT_INSERT)
+	if err != nil {
+		warn("audit: %v", err)
+		tx.Rollback()
+		return
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		ev := row.event
+		_, err = stmt.Exec(row.started.Unix(), ev.Client, row.method, ev.Host, ev.Port,
+			row.path, row.status, ev.BytesUp, ev.BytesDown, ev.Duration, ev.Route)
+		if err != nil {
+			warn("audit: %v", err)
+			tx.Rollback()
+			return
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		warn("audit: %v", err)
+	}
+}
+
+// close writes the rows still queued, once no more are added.
+func (a *auditLog) close() {
+	close(a.queue)
+	<-a.done
+}
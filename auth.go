@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// credentials that matched their hash, as bcrypt is slow enough to
+// notice on every connection. It is emptied with each load.
+var AUTH_VERIFIED = map[[32]byte]bool{}
+var AUTH_MUTEX = &sync.Mutex{}
+
+// loadAuthFile reads an htpasswd file: user:hash lines with bcrypt
+// ($2y$), apr1 ($apr1$) or {SHA} hashes. Blank lines and lines starting
+// with # are skipped. A relative path is taken from the directory of the
+// config file.
+func loadAuthFile(file string) (map[string]string, error) {
+	if file == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(path.Dir(configPath()), file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid AuthFile: %v", err)
+	}
+	defer f.Close()
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid AuthFile %s line %d: no user:hash", file, n)
+		}
+		user, hash := line[:i], line[i+1:]
+		if !knownHash(hash) {
+			return nil, fmt.Errorf("Invalid AuthFile %s line %d: unsupported hash for %s, use bcrypt (htpasswd -B)", file, n, user)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Invalid AuthFile: %v", err)
+	}
+	return users, nil
+}
+
+func knownHash(hash string) bool {
+	for _, prefix := range []string{"$2y$", "$2a$", "$2b$", "$apr1$", "{SHA}"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuthTrusted reads the AuthTrusted entries, CIDRs or single IPs.
+func parseAuthTrusted(entries []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, e := range entries {
+		if ip := net.ParseIP(e); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid AuthTrusted entry %q: %v", e, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// authRequired tells if client has to log in: AuthFile is set and the
+// client is not in an AuthTrusted network.
+func authRequired(cfg *routerConfig, client net.Conn) bool {
+	if cfg.authUsers == nil {
+		return false
+	}
+	ip := net.ParseIP(clientIP(client))
+	for _, n := range cfg.authTrusted {
+		if ip != nil && n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkCredentials tells if user and pass match AuthFile.
+func checkCredentials(cfg *routerConfig, user, pass string) bool {
+	hash, ok := cfg.authUsers[user]
+	if !ok {
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + pass + "\x00" + hash))
+	AUTH_MUTEX.Lock()
+	verified := AUTH_VERIFIED[key]
+	AUTH_MUTEX.Unlock()
+	if verified {
+		return true
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		ok = subtle.ConstantTimeCompare([]byte(apr1(pass, hash)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		want := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		ok = subtle.ConstantTimeCompare([]byte(want), []byte(hash)) == 1
+	default:
+		ok = bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	}
+	if ok {
+		AUTH_MUTEX.Lock()
+		AUTH_VERIFIED[key] = true
+		AUTH_MUTEX.Unlock()
+	}
+	return ok
+}
+
+// clearAuthCache forgets the verified credentials, once AuthFile was
+// loaded again.
+func clearAuthCache() {
+	AUTH_MUTEX.Lock()
+	AUTH_VERIFIED = map[[32]byte]bool{}
+	AUTH_MUTEX.Unlock()
+}
+
+const APR1_ITOA64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 is the Apache MD5 crypt of pass, with the salt of hash
+// ($apr1$salt$...).
+func apr1(pass, hash string) string {
+	salt := strings.TrimPrefix(hash, "$apr1$")
+	if i := strings.Index(salt, "$"); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.Sum([]byte(pass + salt + pass))
+	ctx := bytes.NewBufferString(pass + "$apr1$" + salt)
+	for i := len(pass); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alt[:])
+		} else {
+			ctx.Write(alt[:i])
+		}
+	}
+	for i := len(pass); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.WriteByte(0)
+		} else {
+			ctx.WriteByte(pass[0])
+		}
+	}
+	sum := md5.Sum(ctx.Bytes())
+	for i := 0; i < 1000; i++ {
+		b := []byte{}
+		if i&1 == 1 {
+			b = append(b, pass...)
+		} else {
+			b = append(b, sum[:]...)
+		}
+		if i%3 != 0 {
+			b = append(b, salt...)
+		}
+		if i%7 != 0 {
+			b = append(b, pass...)
+		}
+		if i&1 == 1 {
+			b = append(b, sum[:]...)
+		} else {
+			b = append(b, pass...)
+		}
+		sum = md5.Sum(b)
+	}
+
+	out := []byte("$apr1$" + salt + "$")
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out = append(out, APR1_ITOA64[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(sum[0], sum[6], sum[12], 4)
+	encode(sum[1], sum[7], sum[13], 4)
+	encode(sum[2], sum[8], sum[14], 4)
+	encode(sum[3], sum[9], sum[15], 4)
+	encode(sum[4], sum[10], sum[5], 4)
+	encode(0, 0, sum[11], 2)
+	return string(out)
+}
+
+// proxyAuthorized tells if the HTTP request req has the Basic
+// Proxy-Authorization of an AuthFile user.
+func proxyAuthorized(cfg *routerConfig, req string) bool {
+	value := headerValue(req, "Proxy-Authorization")
+	if !strings.HasPrefix(strings.ToLower(value), "basic ") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[6:]))
+	if err != nil {
+		return false
+	}
+	i := bytes.IndexByte(decoded, ':')
+	if i < 0 {
+		return false
+	}
+	return checkCredentials(cfg, string(decoded[:i]), string(decoded[i+1:]))
+}
+
+// removeHeader drops the header name from the head of the HTTP request
+// req, so that Proxy-Authorization is not passed on to the origin.
+func removeHeader(req, name string) string {
+	end := strings.Index(req, "\r\n\r\n")
+	if end < 0 {
+		return req
+	}
+	prefix := strings.ToLower(name) + ":"
+	lines := strings.Split(req[:end], "\r\n")
+	kept := lines[:1]
+	for _, line := range lines[1:] {
+		if !strings.HasPrefix(strings.ToLower(line), prefix) {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\r\n") + req[end:]
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/mitnk/goutils/encrypt"
+)
+
+// runBenchmark pushes mb megabytes through handleRemote with cfg, from a
+// loopback client to a loopback lightsocks server and then back, and
+// prints the throughput of each way and the allocations. The two ways run
+// one after the other, so neither end has to read and write at once.
+func runBenchmark(cfg *routerConfig, mb int64) {
+	sum := sha256.Sum256([]byte("goixy-benchmark"))
+	key := sum[:]
+	total := mb * 1024 * 1024
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Printf("benchmark: %v\n", err)
+		os.Exit(2)
+	}
+	defer server.Close()
+	go benchServer(server, key, total)
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Printf("benchmark: %v\n", err)
+		os.Exit(2)
+	}
+	defer local.Close()
+	_, sport, _ := net.SplitHostPort(server.Addr().String())
+	r := Remote{Host: "127.0.0.1", Port: sport, Key: key, Route: ROUTE_UPSTREAM}
+	// the relay settings of cfg apply, not the checks of the destination
+	bench := *cfg
+	bench.ResolveLocally = false
+	bench.allowDestinations = nil
+	go func() {
+		client, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		handleRemote(&bench, newConnLog(), client, "benchmark", sport, r, nil, nil, false, false, false)
+	}()
+
+	conn, err := net.Dial("tcp", local.Addr().String())
+	if err != nil {
+		fmt.Printf("benchmark: %v\n", err)
+		os.Exit(2)
+	}
+	defer conn.Close()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	chunk := make([]byte, 8192)
+	for sent := int64(0); sent < total; sent += int64(len(chunk)) {
+		_, err = conn.Write(chunk[:minInt(len(chunk), int(total-sent))])
+		if err != nil {
+			fmt.Printf("benchmark: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	// the server starts sending once it got everything
+	_, err = io.ReadFull(conn, chunk[:1])
+	up := time.Since(start)
+	if err == nil {
+		start = time.Now()
+		_, err = io.CopyN(ioutil.Discard, conn, total-1)
+	}
+	down := time.Since(start)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		fmt.Printf("benchmark: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("up:   %d MB in %v, %.2f MB/s\n", mb, up.Round(time.Millisecond), float64(mb)/up.Seconds())
+	fmt.Printf("down: %d MB in %v, %.2f MB/s\n", mb, down.Round(time.Millisecond), float64(mb)/down.Seconds())
+	mallocs := int64(after.Mallocs - before.Mallocs)
+	fmt.Printf("%d allocations (%d per MB), %s allocated\n",
+		mallocs, mallocs/(2*mb), fmtHumanBytes(int64(after.TotalAlloc-before.TotalAlloc)))
+}
+
+// benchServer serves one lightsocks connection: it reads total bytes of
+// frames, then sends total bytes back.
+func benchServer(ln net.Listener, key []byte, total int64) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	// check bytes, host, then port
+	for i := 0; i < 2; i++ {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, b[0])); err != nil {
+			return
+		}
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		return
+	}
+	for got := int64(0); got < total; {
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		buffer := make([]byte, binary.BigEndian.Uint16(b))
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			return
+		}
+		data, err := encrypt.Decrypt(buffer, key)
+		if err != nil {
+			return
+		}
+		got += int64(len(data))
+	}
+	r := Remote{Key: key}
+	chunk := make([]byte, 8192)
+	for sent := int64(0); sent < total; sent += int64(len(chunk)) {
+		writeFrame(conn, chunk[:minInt(len(chunk), int(total-sent))], r)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// times a read waited for BufferBudget
+var METRIC_BUFFER_WAITS = expvar.NewInt("buffer_waits")
+
+// bufferBudget is a weighted semaphore over the bytes that readers have
+// handed to handleRemote and it has not relayed yet. With BufferBudget
+// set, a reader that got data waits for others to be relayed before it
+// reads on, so memory stays bounded under load and the peers are slowed
+// down by TCP flow control. Readers idle in Read hold none of it, and a
+// buffer for a peer that stopped reading is given back after BUFFER_HOLD,
+// so neither can starve the others.
+type bufferBudget struct {
+	size int64 // 0 for no limit, read atomically
+	mu   sync.Mutex
+	cond *sync.Cond
+	used int64
+}
+
+var BUFFER_BUDGET = newBufferBudget()
+
+// how long one buffer counts against BufferBudget at most
+var BUFFER_HOLD = 5 * time.Second
+
+// bufferHold is the share of BufferBudget taken for one buffer, given back
+// once, either when it is relayed or when BUFFER_HOLD passed.
+type bufferHold struct {
+	n     int64
+	timer *time.Timer
+	done  bool // under the budget's mu
+}
+
+func newBufferBudget() *bufferBudget {
+	b := &bufferBudget{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *bufferBudget) setSize(size int64) {
+	b.mu.Lock()
+	atomic.StoreInt64(&b.size, size)
+	if size <= 0 {
+		b.used = 0
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// acquire takes n bytes, waiting until they fit. The hold it returns is
+// nil when there is no limit.
+func (b *bufferBudget) acquire(n int) *bufferHold {
+	size := atomic.LoadInt64(&b.size)
+	if size <= 0 || n <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// a buffer larger than the whole budget waits for an empty one
+	need := int64(n)
+	if need > size {
+		need = size
+	}
+	if b.used+need > size {
+		METRIC_BUFFER_WAITS.Add(1)
+	}
+	for b.used+need > b.size && b.size > 0 {
+		b.cond.Wait()
+	}
+	b.used += int64(n)
+	// the timer cannot release h before it is set, as that takes mu
+	h := &bufferHold{n: int64(n)}
+	h.timer = time.AfterFunc(BUFFER_HOLD, func() { b.release(h) })
+	return h
+}
+
+// release gives the bytes of h back, unless it already was. The count
+// never goes below zero, as a reload that lifts BufferBudget forgets what
+// was taken.
+func (b *bufferBudget) release(h *bufferHold) {
+	if h == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if h.done {
+		return
+	}
+	h.done = true
+	h.timer.Stop()
+	b.used -= h.n
+	if b.used < 0 {
+		b.used = 0
+	}
+	b.cond.Broadcast()
+}
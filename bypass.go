@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// BypassList is a NO_PROXY style list: host names (matching subdomains
+// too), IPs and CIDRs, or "*" for everything.
+type BypassList struct {
+	all   bool
+	hosts []string
+	nets  []*net.IPNet
+}
+
+// loadBypass reads the bypass list from the environment. GOIXY_BYPASS
+// wins over NO_PROXY, so the latter can be kept for other tools.
+func loadBypass() *BypassList {
+	for _, name := range []string{"GOIXY_BYPASS", "NO_PROXY", "no_proxy"} {
+		if v, ok := os.LookupEnv(name); ok {
+			return parseBypass(v)
+		}
+	}
+	return &BypassList{}
+}
+
+func parseBypass(s string) *BypassList {
+	return parseHostList(strings.Split(s, ","))
+}
+
+// parseHostList reads entries for a BypassList, as for AllowDestinations.
+func parseHostList(entries []string) *BypassList {
+	b := &BypassList{}
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			b.all = true
+			continue
+		}
+		if _, n, err := net.ParseCIDR(entry); err == nil {
+			b.nets = append(b.nets, n)
+			continue
+		}
+		// a port is allowed but ignored, as curl does
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		b.hosts = append(b.hosts, strings.Trim(entry, "[]"))
+	}
+	return b
+}
+
+func (b *BypassList) match(shost string) bool {
+	if b.all {
+		return true
+	}
+	shost = strings.ToLower(strings.Trim(shost, "[]"))
+	if ip := net.ParseIP(shost); ip != nil {
+		for _, n := range b.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		for _, h := range b.hosts {
+			if hip := net.ParseIP(h); hip != nil && hip.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	shost = strings.TrimSuffix(shost, ".")
+	for _, h := range b.hosts {
+		if shost == h || strings.HasSuffix(shost, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// destinationAllowed tells if AllowDestinations lets goixy reach name,
+// or ip when it was resolved locally (else "").
+func destinationAllowed(cfg *routerConfig, name, ip string) bool {
+	if cfg.allowDestinations == nil {
+		return true
+	}
+	return cfg.allowDestinations.match(name) || (ip != "" && cfg.allowDestinations.match(ip))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/orcaman/concurrent-map"
+)
+
+// per client IP: active connection count and lifetime bytes. Entries are
+// kept after the last connection closes so the totals survive.
+var CLIENT_INFO = cmap.New()
+
+// how many clients the report lists
+var TOP_CLIENTS = 10
+
+func clientIP(client net.Conn) string {
+	host, _, err := net.SplitHostPort(client.RemoteAddr().String())
+	if err != nil {
+		return client.RemoteAddr().String()
+	}
+	return host
+}
+
+func initClients(key string) {
+	MUTEX.Lock()
+	defer MUTEX.Unlock()
+
+	if m, ok := CLIENT_INFO.Get(key); ok {
+		if tmp, ok := m.(cmap.ConcurrentMap).Get("count"); ok {
+			m.(cmap.ConcurrentMap).Set("count", tmp.(int64)+1)
+		}
+	} else {
+		m := cmap.New()
+		m.Set("count", int64(1))
+		m.Set("bytes", int64(0))
+		CLIENT_INFO.Set(key, m)
+	}
+}
+
+func incrClients(key string, n int64) {
+	MUTEX.Lock()
+	defer MUTEX.Unlock()
+
+	if m, ok := CLIENT_INFO.Get(key); ok {
+		if tmp, ok := m.(cmap.ConcurrentMap).Get("bytes"); ok {
+			m.(cmap.ConcurrentMap).Set("bytes", tmp.(int64)+n)
+		}
+	}
+}
+
+func doneClients(key string) {
+	MUTEX.Lock()
+	defer MUTEX.Unlock()
+
+	if m, ok := CLIENT_INFO.Get(key); ok {
+		if tmp, ok := m.(cmap.ConcurrentMap).Get("count"); ok {
+			m.(cmap.ConcurrentMap).Set("count", tmp.(int64)-1)
+		}
+	}
+}
+
+func clientsReport() []string {
+	MUTEX.Lock()
+	defer MUTEX.Unlock()
+
+	type clientStat struct {
+		ip    string
+		count int64
+		bytes int64
+	}
+	stats := []clientStat{}
+	for _, key := range CLIENT_INFO.Keys() {
+		if tmp, ok := CLIENT_INFO.Get(key); ok {
+			cs := clientStat{ip: key}
+			if tmp, ok := tmp.(cmap.ConcurrentMap).Get("count"); ok {
+				cs.count = tmp.(int64)
+			}
+			if tmp, ok := tmp.(cmap.ConcurrentMap).Get("bytes"); ok {
+				cs.bytes = tmp.(int64)
+			}
+			stats = append(stats, cs)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].bytes > stats[j].bytes
+	})
+
+	lines := []string{fmt.Sprintf("[REPORT] %d clients", len(stats))}
+	for i, cs := range stats {
+		if i >= TOP_CLIENTS {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("[REPORT] [client %d] %s(%d): %s",
+			i, cs.ip, cs.count, fmtHumanBytes(cs.bytes)))
+	}
+	return lines
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// the largest CoalesceSize, so that frames stay well within their 2-byte
+// length
+const MAX_COALESCE_SIZE = 32768
+
+// frameCoalescer collects small client reads for up to CoalesceDelay
+// milliseconds, or until CoalesceSize bytes, and sends them upstream as
+// one frame. A nil *frameCoalescer holds nothing and never fires.
+type frameCoalescer struct {
+	pending []byte
+	size    int
+	delay   time.Duration
+	ch      <-chan time.Time
+}
+
+func newFrameCoalescer(cfg *routerConfig) *frameCoalescer {
+	size := cfg.CoalesceSize
+	if size <= 0 {
+		size = 8192
+	}
+	return &frameCoalescer{
+		size:  size,
+		delay: time.Millisecond * time.Duration(cfg.CoalesceDelay),
+	}
+}
+
+func (c *frameCoalescer) add(remote net.Conn, r Remote, data []byte) error {
+	if len(c.pending)+len(data) > c.size {
+		if err := c.flush(remote, r); err != nil {
+			return err
+		}
+	}
+	c.pending = append(c.pending, data...)
+	if len(c.pending) >= c.size {
+		return c.flush(remote, r)
+	}
+	if c.ch == nil {
+		c.ch = time.After(c.delay)
+	}
+	return nil
+}
+
+// timer fires when the pending data is due
+func (c *frameCoalescer) timer() <-chan time.Time {
+	if c == nil {
+		return nil
+	}
+	return c.ch
+}
+
+func (c *frameCoalescer) flush(remote net.Conn, r Remote) error {
+	if c == nil || len(c.pending) == 0 {
+		return nil
+	}
+	data := c.pending
+	c.pending = nil
+	c.ch = nil
+	return writeFrame(remote, data, r)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+
+	"go.starlark.net/starlark"
+	"golang.org/x/net/proxy"
+)
+
+// routerConfig is the running config: GoixyConfig and what is compiled
+// from it. applyRouterConfig builds a new one on every load and publishes
+// it whole, and it is never changed after, so a connection takes it once
+// with currentConfig and reads it without locking while a reload goes on.
+type routerConfig struct {
+	GoixyConfig
+
+	key       []byte
+	directKey []byte
+
+	whiteRules   []Rule
+	blackRules   []Rule
+	directRules  []Rule
+	keyRules     []Rule
+	rewriteRules []rewrite
+	whiteHosts   map[string]*uint64
+	// the (^|\.)domain$ rules of whiteRules by domain, and the others
+	whiteDomains map[string]*uint64
+	whiteRegexes []Rule
+	routeScript  starlark.Value
+	// the listRoute of host:port, so repeated connections skip the rules;
+	// each config has its own, so a lookup still running on the old one
+	// cannot fill the new one
+	routeCache *lru
+
+	// the users of AuthFile and their password hashes, nil when clients
+	// do not authenticate, and the AuthTrusted networks
+	authUsers   map[string]string
+	authTrusted []*net.IPNet
+
+	// nil when any destination may be reached
+	allowDestinations *BypassList
+	// destinations forced direct, from GOIXY_BYPASS or else NO_PROXY
+	bypass *BypassList
+
+	// the resolved FlowCollector and the socket to send to it, nil when
+	// not set
+	flowAddr *net.UDPAddr
+	flowConn *net.UDPConn
+
+	// dialer for connections to the remotes, bound to LocalAddr if set,
+	// and for the connection to the upstream, set from UpstreamProxy
+	localDialer    *net.Dialer
+	upstreamDialer proxy.Dialer
+
+	// address sent in SOCKS replies instead of the local one, from
+	// AdvertiseAddr
+	advertiseAddr *net.TCPAddr
+	// pin for the certificate of Host:Port, from UpstreamPin
+	upstreamPin *CertPin
+}
+
+var ROUTER_CONFIG atomic.Value
+
+// the config before any is loaded
+var EMPTY_CONFIG = &routerConfig{
+	whiteHosts:     map[string]*uint64{},
+	whiteDomains:   map[string]*uint64{},
+	routeCache:     newLRU(ROUTE_CACHE_SIZE),
+	bypass:         &BypassList{},
+	localDialer:    &net.Dialer{},
+	upstreamDialer: proxy.Direct,
+}
+
+// currentConfig returns the running config.
+func currentConfig() *routerConfig {
+	if cfg, ok := ROUTER_CONFIG.Load().(*routerConfig); ok {
+		return cfg
+	}
+	return EMPTY_CONFIG
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// yamlToJSON converts a YAML config to JSON, so it is decoded into
+// GoixyConfig exactly like config.json, with the same key names.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	err := yaml.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(yamlToJSONValue(v))
+}
+
+// yaml.v2 decodes maps as map[interface{}]interface{}, which
+// encoding/json cannot marshal.
+func yamlToJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			m[fmt.Sprintf("%v", k)] = yamlToJSONValue(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = yamlToJSONValue(e)
+		}
+		return v
+	}
+	return v
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"sync/atomic"
+)
+
+// defaultControlPath is in the home of the user goixy serves as, which is
+// runUser with -user. user.Current cannot tell it once privileges are
+// dropped, as it keeps the user it first found, root.
+func defaultControlPath(runUser string) string {
+	usr, err := user.Current()
+	if runUser != "" {
+		usr, err = user.Lookup(runUser)
+	}
+	if err != nil {
+		return "goixy.sock"
+	}
+	return path.Join(usr.HomeDir, ".goixy/control.sock")
+}
+
+// serveControl answers every connection on the unix socket at sockPath with
+// the current report, so that `goixy stats` can read it.
+func serveControl(sockPath string) {
+	// a stale socket of a previous run would make listen fail
+	if conn, err := net.Dial("unix", sockPath); err == nil {
+		conn.Close()
+		info("control socket %s is in use, not serving stats", sockPath)
+		return
+	}
+	os.Remove(sockPath)
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		info("control listen: %v", err)
+		return
+	}
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(conn, "%d clients connected\n", atomic.LoadInt64(&COUNT_CONNECTED))
+		for _, line := range append(serversReport(), clientsReport()...) {
+			fmt.Fprintln(conn, line)
+		}
+		conn.Close()
+	}
+}
+
+func printStats(sockPath string) {
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		fmt.Printf("cannot connect to goixy: %v\n", err)
+		os.Exit(2)
+	}
+	defer conn.Close()
+	io.Copy(os.Stdout, conn)
+}
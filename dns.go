@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type dnsEntry struct {
+	ip      string
+	expires time.Time
+}
+
+// the system resolver, for names and for the PTR names of ReverseDNS
+type systemResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+var SYSTEM_RESOLVER systemResolver = net.DefaultResolver
+
+var DNS_CACHE = map[string]dnsEntry{}
+var DNS_MUTEX = &sync.Mutex{}
+
+// TTL of system resolver answers, which come without one, and the bounds
+// put on the TTLs of DoH answers
+var DNS_TTL = 5 * time.Minute
+var DNS_MIN_TTL = 10 * time.Second
+var DNS_MAX_TTL = time.Hour
+var DNS_TIMEOUT = 5 * time.Second
+
+// the DoH client dials with the localDialer, never through goixy itself
+var DOH_CLIENT = &http.Client{
+	Timeout: DNS_TIMEOUT,
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return currentConfig().localDialer.DialContext(ctx, network, addr)
+		},
+	},
+}
+
+// resolveHost returns an IP of host for ResolveLocally, from DoHURL when
+// set (falling back to the system resolver with DoHFallback) or else the
+// system resolver. Answers are cached for their TTL, failures are not.
+func resolveHost(cfg *routerConfig, lg connLog, host string) (string, error) {
+	DNS_MUTEX.Lock()
+	e, ok := DNS_CACHE[host]
+	DNS_MUTEX.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.ip, nil
+	}
+
+	var ip string
+	var ttl time.Duration
+	var err error
+	if cfg.DoHURL != "" {
+		ip, ttl, err = lookupDoH(cfg.DoHURL, host)
+		// a name the DoH server does not know is an answer, asking the
+		// system resolver about it would leak it
+		notFound := false
+		if e, ok := err.(*net.DNSError); ok {
+			notFound = e.IsNotFound
+		}
+		if err != nil && cfg.DoHFallback && !notFound {
+			lg.warn("DoH lookup of %s: %v, use the system resolver", host, err)
+			ip, ttl, err = lookupSystem(host)
+		}
+	} else {
+		ip, ttl, err = lookupSystem(host)
+	}
+	if err != nil {
+		return "", err
+	}
+	lg.debug("resolved %s to %s", host, ip)
+	DNS_MUTEX.Lock()
+	DNS_CACHE[host] = dnsEntry{ip, time.Now().Add(ttl)}
+	DNS_MUTEX.Unlock()
+	return ip, nil
+}
+
+func lookupSystem(host string) (string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DNS_TIMEOUT)
+	defer cancel()
+	addrs, err := SYSTEM_RESOLVER.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", 0, err
+	}
+	// prefer IPv4, like the upstream would
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return addr.IP.String(), DNS_TTL, nil
+		}
+	}
+	if len(addrs) == 0 {
+		return "", 0, fmt.Errorf("no address for %s", host)
+	}
+	return addrs[0].IP.String(), DNS_TTL, nil
+}
+
+// lookupDoH asks the DNS-over-HTTPS server at url (RFC 8484, GET) for
+// the A records of host, then the AAAA ones.
+func lookupDoH(url, host string) (string, time.Duration, error) {
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		ip, ttl, err := queryDoH(url, host, qtype)
+		if err != nil {
+			return "", 0, err
+		}
+		if ip != "" {
+			return ip, ttl, nil
+		}
+	}
+	return "", 0, &net.DNSError{Err: "no address", Name: host, IsNotFound: true}
+}
+
+// queryDoH returns the first address of type qtype for host, or "" when
+// there is none.
+func queryDoH(url, host string, qtype dnsmessage.Type) (string, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return "", 0, err
+	}
+	// the ID is 0 for HTTP caching, as RFC 8484 recommends
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return "", 0, err
+	}
+	req, err := http.NewRequest("GET", url+"?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := DOH_CLIENT.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("DoH server: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, 65535))
+	if err != nil {
+		return "", 0, err
+	}
+
+	var reply dnsmessage.Message
+	err = reply.Unpack(body)
+	if err != nil {
+		return "", 0, err
+	}
+	if reply.RCode == dnsmessage.RCodeNameError {
+		return "", 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if reply.RCode != dnsmessage.RCodeSuccess {
+		return "", 0, fmt.Errorf("DoH server: %v", reply.RCode)
+	}
+	for _, answer := range reply.Answers {
+		ttl := time.Duration(answer.Header.TTL) * time.Second
+		if ttl < DNS_MIN_TTL {
+			ttl = DNS_MIN_TTL
+		} else if ttl > DNS_MAX_TTL {
+			ttl = DNS_MAX_TTL
+		}
+		// CNAMEs come first, skip them for the address they lead to
+		switch rr := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			return net.IP(rr.A[:]).String(), ttl, nil
+		case *dnsmessage.AAAAResource:
+			return net.IP(rr.AAAA[:]).String(), ttl, nil
+		}
+	}
+	return "", 0, nil
+}
+
+// clearDNSCache drops the cached answers, as a reload may change DoHURL.
+func clearDNSCache() {
+	DNS_MUTEX.Lock()
+	DNS_CACHE = map[string]dnsEntry{}
+	DNS_MUTEX.Unlock()
+}
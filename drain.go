@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync"
+)
+
+// relay is a connection handled by handleRemote, kept so that a reload
+// with ReloadDrain can close it if its route changed.
+type relay struct {
+	lg     connLog
+	shost  string
+	sport  string
+	client string
+	socks  bool
+	r      Remote
+	remote net.Conn
+}
+
+var RELAYS = map[*relay]bool{}
+var RELAYS_MUTEX = &sync.Mutex{}
+
+func trackRelay(rl *relay) {
+	RELAYS_MUTEX.Lock()
+	RELAYS[rl] = true
+	RELAYS_MUTEX.Unlock()
+}
+
+func untrackRelay(rl *relay) {
+	RELAYS_MUTEX.Lock()
+	delete(RELAYS, rl)
+	RELAYS_MUTEX.Unlock()
+}
+
+// drainChangedRoutes closes the relays that the running config would now
+// route elsewhere, or refuse, so that their clients reconnect with the
+// new routing. Closing the remote ends the relay like a remote close.
+func drainChangedRoutes() {
+	cfg := currentConfig()
+	RELAYS_MUTEX.Lock()
+	relays := []*relay{}
+	for rl := range RELAYS {
+		relays = append(relays, rl)
+	}
+	RELAYS_MUTEX.Unlock()
+
+	n := 0
+	for _, rl := range relays {
+		now, ok := getRemoteInfo(cfg, rl.lg, rl.shost, rl.sport, rl.client, rl.socks, rl.r.Override)
+		if ok && !serverInBlackList(cfg, rl.shost, rl.sport) && sameRoute(cfg, rl.r, now) {
+			continue
+		}
+		rl.lg.info("route of %s:%s changed on reload, closing", rl.shost, rl.sport)
+		rl.remote.Close()
+		n += 1
+	}
+	if n > 0 {
+		info("closed %d connections with changed routes", n)
+	}
+}
+
+// sameRoute tells if a connection through old would still go there with
+// cfg, whose route is now. Any of Upstreams would do, as they are picked
+// at random.
+func sameRoute(cfg *routerConfig, old, now Remote) bool {
+	if old.Route != now.Route || old.Type != now.Type || !bytes.Equal(old.Key, now.Key) {
+		return false
+	}
+	if old.DestHost != now.DestHost || old.DestPort != now.DestPort {
+		return false
+	}
+	if old.Route != ROUTE_UPSTREAM || len(cfg.Upstreams) == 0 {
+		return old.Host == now.Host && old.Port == now.Port
+	}
+	for _, s := range cfg.Upstreams {
+		if s.Host == old.Host && s.Port == old.Port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// FlowRecord is sent as one JSON datagram to FlowCollector when a
+// connection to a remote closes.
+type FlowRecord struct {
+	Src       string  `json:"src"`
+	SrcPort   int     `json:"src_port"`
+	Dst       string  `json:"dst"`
+	DstPort   int     `json:"dst_port"`
+	Route     string  `json:"route"`
+	BytesUp   int64   `json:"bytes_up"`
+	BytesDown int64   `json:"bytes_down"`
+	Start     int64   `json:"start_ms"`
+	End       int64   `json:"end_ms"`
+	Duration  float64 `json:"duration"`
+}
+
+func resolveFlowCollector(collector string) (*net.UDPAddr, error) {
+	if collector == "" {
+		return nil, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", collector)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid FlowCollector %q: %v", collector, err)
+	}
+	return addr, nil
+}
+
+// openFlowConn returns the socket the records to addr are sent from: the
+// one of the running config, so that a reload keeps it, or else a new one.
+// The socket is not connected, so it serves a changed FlowCollector too;
+// applyRouterConfig closes it when FlowCollector is removed.
+func openFlowConn(addr *net.UDPAddr) (*net.UDPConn, error) {
+	if addr == nil {
+		return nil, nil
+	}
+	if conn := currentConfig().flowConn; conn != nil {
+		return conn, nil
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid FlowCollector %s: %v", addr, err)
+	}
+	return conn, nil
+}
+
+// sendFlow sends the record of the closed connection ev, started at
+// started, from client. It is best effort: a lost datagram or a collector
+// that is down only costs the record.
+func sendFlow(cfg *routerConfig, client net.Addr, ev WebhookEvent, started time.Time) {
+	addr := cfg.flowAddr
+	if addr == nil {
+		return
+	}
+	ended := started.Add(time.Duration(ev.Duration * float64(time.Second)))
+	flow := FlowRecord{
+		Src:       ev.Client,
+		Dst:       ev.Host,
+		Route:     ev.Route,
+		BytesUp:   ev.BytesUp,
+		BytesDown: ev.BytesDown,
+		Start:     started.UnixNano() / int64(time.Millisecond),
+		End:       ended.UnixNano() / int64(time.Millisecond),
+		Duration:  ev.Duration,
+	}
+	if tcp, ok := client.(*net.TCPAddr); ok {
+		flow.SrcPort = tcp.Port
+	}
+	flow.DstPort, _ = strconv.Atoi(ev.Port)
+	body, _ := json.Marshal(flow)
+	_, err := cfg.flowConn.WriteToUDP(body, addr)
+	if err != nil {
+		debug("flow collector: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the rule file import-gfwlist writes, next to the config file
+const GFWLIST_FILE = "gfwlist.txt"
+
+var RE_GFW_HOST = regexp.MustCompile(`^[a-z0-9-]+(\.[a-z0-9-]+)+$`)
+
+// importGFWList converts the GFWList at src (a URL or a file) into
+// WhiteList patterns, merged into GFWLIST_FILE, for `goixy import-gfwlist`.
+func importGFWList(src string) {
+	data, err := readGFWList(src)
+	if err != nil {
+		fmt.Printf("cannot read %s: %v\n", src, err)
+		os.Exit(2)
+	}
+	patterns, err := parseGFWList(data)
+	if err != nil {
+		fmt.Printf("cannot parse %s: %v\n", src, err)
+		os.Exit(2)
+	}
+
+	dir := path.Dir(configPath())
+	file := filepath.Join(dir, GFWLIST_FILE)
+	old, err := readRuleFiles([]string{file}, dir)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("cannot read %s: %v\n", file, err)
+		os.Exit(2)
+	}
+	merged := map[string]bool{}
+	for _, p := range old {
+		merged[p] = true
+	}
+	added := 0
+	for _, p := range patterns {
+		if !merged[p] {
+			merged[p] = true
+			added += 1
+		}
+	}
+	lines := []string{}
+	for p := range merged {
+		lines = append(lines, p)
+	}
+	sort.Strings(lines)
+
+	out := fmt.Sprintf("# imported from %s on %s by goixy import-gfwlist\n",
+		src, time.Now().Format("2006-01-02"))
+	out += strings.Join(lines, "\n") + "\n"
+	err = ioutil.WriteFile(file, []byte(out), 0644)
+	if err != nil {
+		fmt.Printf("cannot write %s: %v\n", file, err)
+		os.Exit(2)
+	}
+	fmt.Printf("%s: %d patterns, %d new\n", file, len(lines), added)
+
+	listed := false
+	for _, f := range currentConfig().WhiteListFiles {
+		if f == GFWLIST_FILE || f == file {
+			listed = true
+		}
+	}
+	if !listed {
+		fmt.Printf("add \"WhiteListFiles\": [%q] to %s to use them\n", GFWLIST_FILE, configPath())
+	}
+}
+
+func readGFWList(src string) ([]byte, error) {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return ioutil.ReadFile(src)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// parseGFWList returns a WhiteList pattern for each host of the rules in
+// data, a GFWList: Adblock Plus style rules, usually base64 encoded.
+// Exceptions (@@), regex rules and wildcards goixy cannot match by host
+// are skipped.
+func parseGFWList(data []byte) ([]string, error) {
+	text := string(data)
+	if !strings.Contains(text, "[AutoProxy") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+		if err != nil {
+			return nil, fmt.Errorf("neither a rule list nor base64: %v", err)
+		}
+		text = string(decoded)
+	}
+
+	hosts := map[string]bool{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") ||
+			strings.HasPrefix(line, "@@") || strings.HasPrefix(line, "/") {
+			continue
+		}
+		if host := gfwRuleHost(line); host != "" {
+			hosts[host] = true
+		}
+	}
+	patterns := []string{}
+	for host := range hosts {
+		if net.ParseIP(host) != nil {
+			patterns = append(patterns, `^`+regexp.QuoteMeta(host)+`$`)
+		} else {
+			patterns = append(patterns, `(^|\.)`+regexp.QuoteMeta(host)+`$`)
+		}
+	}
+	sort.Strings(patterns)
+	return patterns, nil
+}
+
+// gfwRuleHost returns the host a rule like ||example.com, |http://example.com/x,
+// .example.com or example.com/path applies to, or "" when it has none.
+func gfwRuleHost(rule string) string {
+	rule = strings.TrimLeft(rule, "|")
+	if i := strings.Index(rule, "://"); i >= 0 {
+		rule = rule[i+3:]
+	}
+	if i := strings.IndexAny(rule, "/^?"); i >= 0 {
+		rule = rule[:i]
+	}
+	rule = strings.TrimPrefix(rule, "*.")
+	rule = strings.Trim(strings.ToLower(rule), ".")
+	if h, _, err := net.SplitHostPort(rule); err == nil {
+		rule = h
+	}
+	if !RE_GFW_HOST.MatchString(rule) {
+		return ""
+	}
+	return rule
+}
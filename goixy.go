@@ -1,22 +1,31 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/mitnk/goutils/encrypt"
@@ -31,21 +40,135 @@ type GoixyConfig struct {
 	DirectHost string
 	DirectPort string
 	DirectKey  string
+
+	WhiteListFiles []string
+	KeyList        []KeyRule
+	Rewrite        []RewriteRule
+
+	UpstreamType string
+	UpstreamUser string
+	UpstreamPass string
+
+	FrontDomain string
+	FrontSNI    string
+
+	ShutdownGrace int64
+
+	BlackList     []string
+	BlockResponse BlockResponse
+
+	DirectList []string
+
+	LogSNI     bool
+	RouteBySNI bool
+
+	FailClosed bool
+
+	UpstreamTLS      bool
+	UpstreamSNI      string
+	UpstreamInsecure bool
+	UpstreamPin      string
+	UpstreamAck      bool
+	SendClientIP     bool
+	ReadyProbe       string
+
+	Upstreams        []UpstreamServer
+	UpstreamSelect   string
+	UpstreamFailures int
+	UpstreamCooldown int64
+
+	UpstreamMetered bool
+	DirectMetered   bool
+
+	Obfuscate       bool
+	ObfuscateJitter int64
+	HandshakeJitter int64
+
+	WhiteListBudget int64
+
+	CoalesceDelay int64
+	CoalesceSize  int
+
+	ClientWriteBuffer int
+	BufferBudget      int64
+
+	SockRcvBuf    int
+	SockSndBuf    int
+	ClientSockBuf bool
+
+	ReloadDrain bool
+
+	MaxConnLifetime  int64
+	FirstByteTimeout int64
+	KeepAlive        int64
+
+	ReverseDNS bool
+
+	ResolveLocally bool
+	DoHURL         string
+	DoHFallback    bool
+
+	RouteScript string
+
+	UpstreamProxy string
+
+	LocalAddr string
+
+	AdvertiseAddr string
+
+	WebhookURL string
+
+	FlowCollector string
+
+	LogLevel string
+
+	ServersTTL int64
+	TopTalkers int
+
+	ResetOnViolation bool
+
+	AuthFile    string
+	AuthTrusted []string
+
+	AllowDestinations []string
+
+	AllowedPorts []int
+
+	Listen []ListenAddr
+
+	NoDelayThreshold int64
+
+	Transport string
+	KCP       KCPConfig
 }
 
-var GC GoixyConfig = GoixyConfig{}
+type BlockResponse struct {
+	Status   int
+	Body     string
+	Redirect string
+}
 
 var VERSION = "1.7.1"
-var KEY = []byte("")
-var DIRECT_KEY = []byte("")
-var COUNT_CONNECTED = 0
-var DEBUG = false
-var VERBOSE = false
+// read and set with atomic, as every log line prints it
+var COUNT_CONNECTED int64 = 0
+
+// read and set with atomic, as SIGUSR2 changes it while connections log
+var LOG_LEVEL int32 = LOG_INFO
+var FLAG_LOG_LEVEL = LOG_ERROR
+// the level the config last asked for, so that a reload keeps the one
+// set by SIGUSR2 unless LogLevel changed; read and set with atomic too
+var CONFIG_LOG_LEVEL int32 = -1
 var WITH_DIRECT = false
+var NO_DIRECT = false
+var TRANSPARENT = false
+var DEBUG_HEADERS = false
 var SPAN_REPORT int64 = 600
 var SPAN_TIMEOUT int64 = 3600
 var TOTAL_BYTES int64 = 0
 
+// the config file, set once at startup by findConfigFile
+var CONFIG_FILE = ""
+
 var SERVER_INFO = cmap.New()
 var MUTEX = &sync.Mutex{}
 
@@ -54,18 +177,70 @@ func main() {
 	port := flag.String("port", "1080", "port")
 	with_direct := flag.Bool("withdirect", false,
 							 "Use Direct proxy (for HTTP Porxy only)")
+	no_direct := flag.Bool("no-direct", false,
+		"refuse hosts not in WhiteList instead of routing them direct")
 	_debug := flag.Bool("v", false, "verbose")
 	verbose := flag.Bool("vv", false, "very verbose")
+	_trace := flag.Bool("vvv", false,
+		"trace, also dumps upstream handshakes (logs key material)")
 	_span_report := flag.Int64("s", 600, "time span to print reports in seconds")
 	_span_timeout := flag.Int64("t", 3600, "time out on connections in seconds")
+	pprof := flag.String("pprof", "",
+		"serve pprof and expvar on host:port (host defaults to 127.0.0.1)")
+	config := flag.String("config", "",
+		"config file, .json or .yaml (default ~/.goixy/config.json)")
+	control := flag.String("control", "",
+		"control socket path (default ~/.goixy/control.sock)")
+	transparent := flag.Bool("transparent", false,
+		"transparent proxy for connections redirected by iptables (Linux)")
+	debug_headers := flag.Bool("debug-headers", false,
+		"add an X-Goixy-Route header to plain HTTP responses")
+	run_user := flag.String("user", "",
+		"switch to this user once listening, e.g. after binding port 443 as root (Linux)")
+	run_group := flag.String("group", "",
+		"switch to this group with -user (default the user's group)")
+	audit_db := flag.String("audit-db", "",
+		"record the relayed HTTP requests and tunnels in this SQLite file")
+	benchmark := flag.Int64("benchmark", 0,
+		"push this many MB through a loopback upstream, print the throughput and exit")
 	flag.Usage = func() {
 		fmt.Printf("Usage of goixy v%s\n", VERSION)
 		fmt.Printf("goixy [flags]\n")
+		fmt.Printf("goixy [-control path] stats\n")
+		fmt.Printf("goixy [flags] routes\n")
+		fmt.Printf("goixy [flags] import-gfwlist <url|file>\n")
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
 	flag.Parse()
-	DEBUG = *_debug
+	// $HOST and $PORT (as set by PaaS platforms) replace the defaults,
+	// explicit flags still win
+	flags_set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { flags_set[f.Name] = true })
+	if !flags_set["host"] && os.Getenv("HOST") != "" {
+		*host = os.Getenv("HOST")
+	}
+	if !flags_set["port"] && os.Getenv("PORT") != "" {
+		*port = os.Getenv("PORT")
+	}
+	CONFIG_FILE = findConfigFile(*config)
+	DEBUG_HEADERS = *debug_headers
+	if *control == "" {
+		*control = defaultControlPath(*run_user)
+	}
+	if flag.Arg(0) == "stats" {
+		printStats(*control)
+		return
+	}
+	if *_debug {
+		FLAG_LOG_LEVEL = LOG_DEBUG
+	}
+	if *verbose {
+		FLAG_LOG_LEVEL = LOG_VERBOSE
+	}
+	if *_trace {
+		FLAG_LOG_LEVEL = LOG_TRACE
+	}
 	SPAN_REPORT = *_span_report
 	if SPAN_REPORT < 10 {
 		SPAN_REPORT = 10
@@ -74,16 +249,50 @@ func main() {
 	if SPAN_TIMEOUT < 60 {
 		SPAN_TIMEOUT = 60
 	}
-	VERBOSE = *verbose
 	WITH_DIRECT = *with_direct
+	NO_DIRECT = *no_direct
+	TRANSPARENT = *transparent
 	loadRouterConfig()
+	if *benchmark > 0 {
+		runBenchmark(currentConfig(), *benchmark)
+		return
+	}
+	if flag.Arg(0) == "routes" {
+		printRoutes()
+		return
+	}
+	if flag.Arg(0) == "import-gfwlist" {
+		if flag.NArg() != 2 {
+			fmt.Printf("usage: goixy [flags] import-gfwlist <url|file>\n")
+			os.Exit(2)
+		}
+		importGFWList(flag.Arg(1))
+		return
+	}
 
 	local, err := net.Listen("tcp", *host+":"+*port)
 	if err != nil {
-		fmt.Printf("net listen: %v\r", err)
+		fmt.Printf("%s\n", listenError(*host+":"+*port, err))
 		os.Exit(2)
 	}
 	defer local.Close()
+	LISTEN_ADDR, _ = local.Addr().(*net.TCPAddr)
+	LISTEN_ADDRS = append(LISTEN_ADDRS, LISTEN_ADDR)
+	extra, err := openListeners(currentConfig().Listen)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(2)
+	}
+	if *run_user != "" {
+		err = dropPrivileges(*run_user, *run_group)
+		if err != nil {
+			fmt.Printf("cannot switch to user %s: %v\n", *run_user, err)
+			os.Exit(2)
+		}
+	} else if *run_group != "" {
+		fmt.Printf("-group needs -user\n")
+		os.Exit(2)
+	}
 
 	_with_or_not := "with"
 	if !WITH_DIRECT {
@@ -91,318 +300,1367 @@ func main() {
 	}
 	info("goixy v%s %s Direct Porxy", VERSION, _with_or_not)
 	info("listen on port: %s:%s", *host, *port)
+	listeners := []net.Listener{}
+	for _, l := range extra {
+		if l.route != "" {
+			info("listen on port: %s, route %s", l.ln.Addr(), l.route)
+		} else {
+			info("listen on port: %s", l.ln.Addr())
+		}
+		listeners = append(listeners, l.ln)
+	}
+	if *pprof != "" {
+		startPprof(*pprof)
+	}
 
 	go printServersInfo()
-	for {
-		client, err := local.Accept()
+	go serveControl(*control)
+	go handleSignals(append(listeners, local))
+	go handleReload()
+	go handleLogLevelSignal()
+	go probeUpstreams()
+	startWebhooks()
+	if *audit_db != "" {
+		AUDIT, err = openAudit(*audit_db)
 		if err != nil {
-			continue
+			fmt.Printf("cannot open audit db %s: %v\n", *audit_db, err)
+			os.Exit(2)
 		}
-		go handleClient(client)
 	}
+	for _, l := range extra {
+		go acceptClients(l.ln, l.route)
+	}
+	// the listener is closed by handleSignals, after the others and
+	// SHUTTING_DOWN, so no client is added once we go drain the clients
+	acceptClients(local, "")
+	drainClients(currentConfig().ShutdownGrace)
+	if AUDIT != nil {
+		AUDIT.close()
+	}
+	info("goixy stopped")
 }
 
-func handleClient(client net.Conn) {
-	MUTEX.Lock()
-	COUNT_CONNECTED += 1
-	MUTEX.Unlock()
+// listenError explains why listening on addr failed, with what to do
+// about the common causes.
+func listenError(addr string, err error) string {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Sprintf("cannot listen on %s: address already in use, "+
+			"is another goixy running? Pick another port with -port", addr)
+	}
+	if errors.Is(err, syscall.EACCES) {
+		return fmt.Sprintf("cannot listen on %s: permission denied, "+
+			"ports below 1024 need root (see -user) or a higher -port", addr)
+	}
+	return fmt.Sprintf("cannot listen on %s: %v", addr, err)
+}
+
+// handleClient serves a client accepted on a listener with the given
+// route override ("" to route by the rules).
+func handleClient(client net.Conn, route string) {
+	lg := newConnLog()
+	// a reload during the connection does not change its config
+	cfg := currentConfig()
+	atomic.AddInt64(&COUNT_CONNECTED, 1)
+	trackClient(client)
+	keyClient := clientIP(client)
+	initClients(keyClient)
 	defer func() {
 		client.Close()
-		MUTEX.Lock()
-		COUNT_CONNECTED -= 1
-		MUTEX.Unlock()
-		debug("closed client")
+		atomic.AddInt64(&COUNT_CONNECTED, -1)
+		untrackClient(client)
+		doneClients(keyClient)
+		lg.debug("closed client")
 	}()
-	debug("connected from %v.", client.RemoteAddr())
+	lg.debug("connected from %v.", client.RemoteAddr())
+	if TRANSPARENT {
+		// connections made to goixy itself (not redirected, so there is
+		// no original destination) still get the handshakes
+		shost, sport, err := originalDst(client)
+		if err != nil {
+			lg.debug("no original destination: %v", err)
+		} else if net.JoinHostPort(shost, sport) != client.LocalAddr().String() {
+			handleTransparent(cfg, lg, client, shost, sport, route)
+			return
+		}
+	}
 
 	data := make([]byte, 1)
 	n, err := client.Read(data)
 	if err != nil || n != 1 {
-		info("cannot read init data from client")
+		lg.info("cannot read init data from client")
 		return
 	}
 	if data[0] == 5 {
-		verbose("handle with socks v5")
-		handleSocks(client)
+		lg.verbose("handle with socks v5")
+		handleSocks(cfg, lg, client, route)
 	} else if data[0] > 5 {
-		verbose("handle with http")
-		handleHTTP(client, data[0])
+		lg.verbose("handle with http")
+		handleHTTP(cfg, lg, client, data[0], route)
 	} else {
-		info("Error: only support HTTP and Socksv5")
+		lg.info("Error: only support HTTP and Socksv5")
+		resetOnViolation(cfg, client)
+	}
+}
+
+// an HTTP/2 server preface (an empty SETTINGS frame), then a GOAWAY with
+// HTTP_1_1_REQUIRED, so that h2 clients retry with HTTP/1.1
+var H2_REFUSAL = []byte{
+	0, 0, 0, 4, 0, 0, 0, 0, 0,
+	0, 0, 8, 7, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xd,
+}
+
+// resetOnViolation makes closing client send a TCP reset instead of a
+// FIN when ResetOnViolation is set, for clients that broke the protocol.
+func resetOnViolation(cfg *routerConfig, client net.Conn) {
+	if !cfg.ResetOnViolation {
+		return
+	}
+	if tc := tcpConn(client); tc != nil {
+		tc.SetLinger(0)
+	}
+}
+
+func handleSocks(cfg *routerConfig, lg connLog, client net.Conn, route string) {
+	// a client sending a truncated request must not hold the connection
+	client.SetReadDeadline(time.Now().Add(SOCKS_REQUEST_TIMEOUT))
+	shost, sport, err := readSocksRequest(cfg, client, authRequired(cfg, client))
+	client.SetReadDeadline(time.Time{})
+	if err != nil {
+		logSocksError(lg, err)
+		resetOnViolation(cfg, client)
+		return
+	}
+	if serverInBlackList(cfg, shost, sport) {
+		lg.info("blocked %s:%s", shost, sport)
+		// connection not allowed by ruleset
+		client.Write(socksReply(2, nil))
+		return
+	}
+	lg.info("connect to server %s:%s", shost, sport)
+
+	// the reply to establish the socks v5 connection is sent by
+	// handleRemote once the remote is connected
+	r, ok := getRemoteInfo(cfg, lg, shost, sport, clientIP(client), true, route)
+	if !ok {
+		lg.info("refused %s:%s by routing rules", shost, sport)
+		client.Write(socksReply(2, nil))
+		return
 	}
+	if routingLoop(shost, sport, r) {
+		lg.warn("loop detected: %s:%s via %s:%s leads back to goixy", shost, sport, r.Host, r.Port)
+		client.Write(socksReply(2, nil))
+		return
+	}
+	handleRemote(cfg, lg, client, shost, sport, r, nil, nil, false, true, false)
+}
+
+// handleTransparent relays a connection redirected to goixy, whose
+// destination came from the socket instead of a handshake. It is routed
+// like an HTTP connection, so -withdirect applies.
+func handleTransparent(cfg *routerConfig, lg connLog, client net.Conn, shost, sport, route string) {
+	if serverInBlackList(cfg, shost, sport) {
+		lg.info("blocked %s:%s", shost, sport)
+		return
+	}
+	lg.info("connect to server %s:%s (transparent)", shost, sport)
+	r, ok := getRemoteInfo(cfg, lg, shost, sport, clientIP(client), false, route)
+	if !ok {
+		lg.info("refused %s:%s by routing rules", shost, sport)
+		return
+	}
+	if routingLoop(shost, sport, r) {
+		lg.warn("loop detected: %s:%s via %s:%s leads back to goixy", shost, sport, r.Host, r.Port)
+		return
+	}
+	handleRemote(cfg, lg, client, shost, sport, r, nil, nil, false, false, false)
+}
+
+// SocksError is a failed SOCKS5 handshake, with the stage it failed at.
+type SocksError struct {
+	Stage string
+	Err   error
 }
 
-func handleSocks(client net.Conn) {
+func (e *SocksError) Error() string {
+	return fmt.Sprintf("socks %s: %v", e.Stage, e.Err)
+}
+
+// failures per SocksError stage, shown in the report
+var SOCKS_ERRORS = map[string]int64{}
+
+func logSocksError(lg connLog, err error) {
+	lg.info("%v", err)
+	if se, ok := err.(*SocksError); ok {
+		MUTEX.Lock()
+		SOCKS_ERRORS[se.Stage] += 1
+		MUTEX.Unlock()
+	}
+}
+
+// readSocksRequest does the SOCKS5 method negotiation (the version byte
+// is already read) and reads the request up to the destination port.
+// When auth is set the client has to log in with username/password,
+// otherwise it may also connect without authentication.
+func readSocksRequest(cfg *routerConfig, client io.ReadWriter, auth bool) (string, string, error) {
 	buffer := make([]byte, 1)
 	_, err := io.ReadFull(client, buffer)
 	if err != nil {
-		info("cannot read from client")
-		return
+		return "", "", &SocksError{"method count", err}
+	}
+	if buffer[0] == 0 {
+		// no acceptable methods
+		client.Write([]byte{5, 0xff})
+		return "", "", &SocksError{"method count", errors.New("empty method list")}
 	}
 	buffer = make([]byte, buffer[0])
 	_, err = io.ReadFull(client, buffer)
 	if err != nil {
-		info("cannot read from client")
-		return
+		return "", "", &SocksError{"methods", err}
 	}
-	if !byteInArray(0, buffer) {
-		info("client not support bare connect")
-		return
+	// send initial SOCKS5 response (VER, METHOD): no authentication
+	// when allowed, else username/password (RFC 1929) for the users of
+	// AuthFile
+	if !auth && byteInArray(0, buffer) {
+		handshakeJitter(cfg)
+		client.Write([]byte{5, 0})
+	} else if cfg.authUsers != nil && byteInArray(2, buffer) {
+		handshakeJitter(cfg)
+		client.Write([]byte{5, 2})
+		err = readSocksAuth(cfg, client)
+		if err != nil {
+			return "", "", err
+		}
+	} else {
+		client.Write([]byte{5, 0xff})
+		if auth {
+			return "", "", &SocksError{"methods", errors.New("client not support username/password auth")}
+		}
+		return "", "", &SocksError{"methods", errors.New("client not support bare connect")}
 	}
 
-	// send initial SOCKS5 response (VER, METHOD)
-	client.Write([]byte{5, 0})
-
 	buffer = make([]byte, 4)
 	_, err = io.ReadFull(client, buffer)
 	if err != nil {
-		info("failed to read (ver, cmd, rsv, atyp) from client")
-		return
+		return "", "", &SocksError{"request header", err}
 	}
 	ver, cmd, atyp := buffer[0], buffer[1], buffer[3]
 	if ver != 5 {
-		info("ver should be 5, got %v", ver)
-		return
+		return "", "", &SocksError{"request header", fmt.Errorf("ver should be 5, got %v", ver)}
 	}
-	// 1: connect 2: bind
-	if cmd != 1 && cmd != 2 {
-		info("bad cmd:%v", cmd)
-		return
+	// only 1 (connect); 2 (bind) and 3 (udp associate) are not supported
+	if cmd != 1 {
+		client.Write(socksReply(7, nil))
+		return "", "", &SocksError{"request header", fmt.Errorf("unsupported cmd: %v", cmd)}
 	}
 	shost := ""
-	sport := ""
 	if atyp == ATYP_IPV6 {
-		info("do not support ipv6 yet")
-		return
+		client.Write(socksReply(8, nil))
+		return "", "", &SocksError{"address", errors.New("do not support ipv6 yet")}
 	} else if atyp == ATYP_DOMAIN {
 		buffer = make([]byte, 1)
 		_, err = io.ReadFull(client, buffer)
 		if err != nil {
-			info("cannot read from client")
-			return
+			return "", "", &SocksError{"domain length", err}
+		}
+		if buffer[0] == 0 {
+			client.Write(socksReply(1, nil))
+			return "", "", &SocksError{"domain length", errors.New("empty domain name")}
 		}
 		buffer = make([]byte, buffer[0])
 		_, err = io.ReadFull(client, buffer)
 		if err != nil {
-			info("cannot read from client")
-			return
+			return "", "", &SocksError{"domain", err}
 		}
 		shost = string(buffer)
 	} else if atyp == ATYP_IPV4 {
 		buffer = make([]byte, 4)
 		_, err = io.ReadFull(client, buffer)
 		if err != nil {
-			info("cannot read from client")
-			return
+			return "", "", &SocksError{"address", err}
 		}
 		shost = net.IP(buffer).String()
 	} else {
-		info("bad atyp: %v", atyp)
-		return
+		// 8: address type not supported
+		client.Write(socksReply(8, nil))
+		return "", "", &SocksError{"address", fmt.Errorf("bad atyp: %#02x", atyp)}
 	}
 
 	buffer = make([]byte, 2)
 	_, err = io.ReadFull(client, buffer)
 	if err != nil {
-		info("cannot read port from client")
-		return
+		return "", "", &SocksError{"port", err}
 	}
-	sport = fmt.Sprintf("%d", binary.BigEndian.Uint16(buffer))
-	info("connect to server %s:%s", shost, sport)
+	sport := fmt.Sprintf("%d", binary.BigEndian.Uint16(buffer))
+	return shost, sport, nil
+}
 
-	// reply to client to estanblish the socks v5 connection
-	client.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
-	rhost, rport, key := getRemoteInfo(shost, true)
-	handleRemote(client, shost, sport, rhost, rport, nil, nil, key)
+// readSocksAuth reads the username/password request of a client and
+// checks it against AuthFile.
+func readSocksAuth(cfg *routerConfig, client io.ReadWriter) error {
+	buffer := make([]byte, 2)
+	_, err := io.ReadFull(client, buffer)
+	if err != nil {
+		return &SocksError{"auth", err}
+	}
+	if buffer[0] != 1 {
+		return &SocksError{"auth", fmt.Errorf("auth ver should be 1, got %v", buffer[0])}
+	}
+	user := make([]byte, buffer[1])
+	_, err = io.ReadFull(client, user)
+	if err != nil {
+		return &SocksError{"auth", err}
+	}
+	_, err = io.ReadFull(client, buffer[:1])
+	if err != nil {
+		return &SocksError{"auth", err}
+	}
+	pass := make([]byte, buffer[0])
+	_, err = io.ReadFull(client, pass)
+	if err != nil {
+		return &SocksError{"auth", err}
+	}
+	if !checkCredentials(cfg, string(user), string(pass)) {
+		client.Write([]byte{1, 1})
+		return &SocksError{"auth", fmt.Errorf("bad credentials for user %q", user)}
+	}
+	client.Write([]byte{1, 0})
+	return nil
+}
+
+// socksReply builds a SOCKS5 reply with code rep. BND.ADDR and BND.PORT
+// come from addr, with ATYP matching its family; nil gives 0.0.0.0:0.
+func socksReply(rep byte, addr net.Addr) []byte {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if a, ok := addr.(*net.TCPAddr); ok {
+		ip = a.IP
+		port = a.Port
+	}
+	b := []byte{5, rep, 0}
+	if ip.To4() != nil {
+		b = append(b, ATYP_IPV4)
+		b = append(b, ip.To4()...)
+	} else {
+		b = append(b, ATYP_IPV6)
+		b = append(b, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// advertiseAddr gives the BND.ADDR/BND.PORT to put in SOCKS replies:
+// AdvertiseAddr when set, for clients on the far side of a NAT, else addr.
+// A port in AdvertiseAddr replaces the port of addr too.
+func advertiseAddr(cfg *routerConfig, addr net.Addr) net.Addr {
+	if cfg.advertiseAddr == nil {
+		return addr
+	}
+	a := *cfg.advertiseAddr
+	if t, ok := addr.(*net.TCPAddr); ok && a.Port == 0 {
+		a.Port = t.Port
+	}
+	return &a
 }
 
-func handleHTTP(client net.Conn, firstByte byte) {
+func handleHTTP(cfg *routerConfig, lg connLog, client net.Conn, firstByte byte, route string) {
 	dataInit := make([]byte, 8192)
 	dataInit[0] = firstByte
 	nDataInit, err := client.Read(dataInit[1:])
 	nDataInit = nDataInit + 1 // plus firstByte
 	if err != nil {
-		info("cannot read init data from client.")
+		lg.info("cannot read init data from client.")
+		return
+	}
+	if bytes.HasPrefix(dataInit[:nDataInit], []byte("PRI * HTTP/2")) {
+		lg.info("HTTP/2 not supported, client sent the prior knowledge preface")
+		client.Write(H2_REFUSAL)
 		return
 	}
 	isForHTTPS := strings.HasPrefix(string(dataInit[:nDataInit]), "CONNECT")
-	verbose("isForHTTPS: %v", isForHTTPS)
-	verbose("got content from client:\n%s", dataInit[:nDataInit])
+	lg.verbose("isForHTTPS: %v", isForHTTPS)
+	lg.verbose("got content from client:\n%s", dataInit[:nDataInit])
 
 	endor := " HTTP/"
 	re := regexp.MustCompile(" .*" + endor)
 	s := re.FindString(string(dataInit[:nDataInit]))
 	if s == "" {
 		// no url found. not valid http proxy protocol?
+		lg.info("no request target in request from client")
+		resetOnViolation(cfg, client)
 		return
 	}
 
 	s = s[1 : len(s)-len(endor)]
-	if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
-		s = "http://" + s
-	}
-	u, err := url.Parse(s)
-	if err != nil {
-		info("bad url: %s", s)
-		return
+	if s == "*" {
+		// asterisk-form (OPTIONS *): the target is only in the Host header
+		s = headerValue(string(dataInit[:nDataInit]), "Host")
+		if s == "" {
+			lg.info("no Host header for asterisk-form request")
+			client.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+			resetOnViolation(cfg, client)
+			return
+		}
 	}
-	sport := ""
-	shost := ""
-	host_, port_, _ := net.SplitHostPort(u.Host)
-	if port_ != "" {
-		sport = port_
-		shost = host_
+	u := &url.URL{Host: s}
+	if isForHTTPS {
+		// authority-form (host:port), there is no URL to parse
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			u.Host = net.JoinHostPort(strings.Trim(s, "[]"), "443")
+		}
 	} else {
+		if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+			s = "http://" + s
+		}
+		u, err = url.Parse(s)
+		if err != nil {
+			lg.info("bad url: %s", s)
+			resetOnViolation(cfg, client)
+			return
+		}
+	}
+	// shost is always unbracketed, like a SOCKS destination; the Host
+	// header keeps the [] of an IPv6 literal from u.Host
+	shost := u.Hostname()
+	sport := u.Port()
+	if sport == "" {
 		sport = "80"
-		shost = u.Host
 	}
-	info("connect to server %s:%s", shost, sport)
-	rhost, rport, key := getRemoteInfo(shost, false)
+	if authRequired(cfg, client) && !proxyAuthorized(cfg, string(dataInit[:nDataInit])) {
+		lg.info("proxy authentication required for %s:%s", shost, sport)
+		client.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n" +
+			"Proxy-Authenticate: Basic realm=\"goixy\"\r\nConnection: close\r\n\r\n"))
+		return
+	}
+	if serverInBlackList(cfg, shost, sport) {
+		lg.info("blocked %s:%s", shost, sport)
+		client.Write(blockResponse(cfg))
+		return
+	}
+	lg.info("connect to server %s:%s", shost, sport)
 
 	var d2c []byte
 	var d2r []byte
+	expectContinue := false
+	peekSNI := isForHTTPS && (cfg.LogSNI || cfg.RouteBySNI)
+	routeHost := shost
+	if peekSNI {
+		// answer first so that the client starts its TLS handshake
+		client.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		hello := peekClientHello(client)
+		if len(hello) > 0 {
+			d2r = hello
+		}
+		sni := parseSNI(hello)
+		if sni != "" && sni != shost {
+			if cfg.LogSNI {
+				lg.info("SNI %s differs from CONNECT host %s", sni, shost)
+			}
+		} else if sni != "" && cfg.LogSNI {
+			lg.info("SNI %s", sni)
+		}
+		if sni != "" && cfg.RouteBySNI {
+			routeHost = sni
+			if serverInBlackList(cfg, sni, sport) {
+				lg.info("blocked %s:%s by SNI %s", shost, sport, sni)
+				return
+			}
+		}
+	}
+	r, ok := getRemoteInfo(cfg, lg, routeHost, sport, clientIP(client), false, route)
+	if !ok {
+		lg.info("refused %s:%s by routing rules", shost, sport)
+		if !peekSNI {
+			client.Write(blockResponse(cfg))
+		}
+		return
+	}
+	if routingLoop(shost, sport, r) {
+		lg.warn("loop detected: %s:%s via %s:%s leads back to goixy", shost, sport, r.Host, r.Port)
+		if !peekSNI {
+			client.Write([]byte("HTTP/1.1 508 Loop Detected\r\nConnection: close\r\n\r\n"))
+		}
+		return
+	}
+
 	if isForHTTPS {
-		d2c = []byte("HTTP/1.0 200 OK\r\n\r\n")
-	} else {
-		// dataInit := encrypt.Encrypt(dataInit[:nDataInit], key)
-		reg1, _ := regexp.Compile("^HEAD https?:..[^/]+/")
-		path := reg1.ReplaceAllString(string(dataInit[:nDataInit]), "HEAD /")
-		reg2, _ := regexp.Compile("^GET https?:..[^/]+/")
-		path = reg2.ReplaceAllString(string(path), "GET /")
-		dataInit := encrypt.Encrypt([]byte(path), key)
-		dataInitLen := make([]byte, 2)
-		binary.BigEndian.PutUint16(dataInitLen, uint16(len(dataInit)))
-		d2r = append(dataInitLen, dataInit...)
-	}
-	handleRemote(client, shost, sport, rhost, rport, d2c, d2r, key)
-}
-
-func getRemoteInfo(shost string, is_socks bool) (string, string, []byte) {
-	rhost := ""
-	rport := ""
-	key := []byte("")
-	if is_socks || !WITH_DIRECT || serverInList(shost) {
-		rhost = GC.Host
-		rport = GC.Port
-		key = KEY
+		if !peekSNI {
+			d2c = []byte("HTTP/1.0 200 OK\r\n\r\n")
+		}
 	} else {
-		rhost = GC.DirectHost
-		rport = GC.DirectPort
-		key = DIRECT_KEY
+		path := string(rewriteRequestLine(dataInit[:nDataInit]))
+		path = ensureHostHeader(lg, path, u.Host)
+		if cfg.authUsers != nil {
+			path = removeHeader(path, "Proxy-Authorization")
+		}
+		d2r = []byte(path)
+		expectContinue = hasExpectContinue(path)
+	}
+	handleRemote(cfg, lg, client, shost, sport, r, d2c, d2r, expectContinue, false, DEBUG_HEADERS && !isForHTTPS)
+}
+
+// rewriteRequestLine turns an absolute-form request target into the
+// origin-form the server expects: "GET http://host/a?b HTTP/1.1" becomes
+// "GET /a?b HTTP/1.1". OPTIONS for the server as a whole goes out as
+// "OPTIONS *". Other targets are left as is.
+func rewriteRequestLine(data []byte) []byte {
+	m := RE_ABSOLUTE_TARGET.FindSubmatchIndex(data)
+	if m == nil {
+		return data
+	}
+	method := string(data[m[2]:m[3]])
+	target := string(data[m[4]:m[5]])
+	if target == "" && method == "OPTIONS" {
+		target = "*"
+	} else if !strings.HasPrefix(target, "/") {
+		target = "/" + target
+	}
+	line := []byte(method + " " + target + " ")
+	return append(line, data[m[1]:]...)
+}
+
+// blockResponse builds the reply for HTTP requests to blacklisted hosts
+// from cfg.BlockResponse: a redirect when Redirect is set, otherwise a
+// plain status (403 by default) with the configured body.
+func blockResponse(cfg *routerConfig) []byte {
+	br := cfg.BlockResponse
+	status := br.Status
+	if status == 0 {
+		status = 403
+		if br.Redirect != "" {
+			status = 302
+		}
+	}
+	body := br.Body
+	if body == "" && br.Redirect == "" {
+		body = http.StatusText(status) + "\n"
+	}
+	s := fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	if br.Redirect != "" {
+		s += "Location: " + br.Redirect + "\r\n"
+	}
+	s += "Content-Type: text/plain; charset=utf-8\r\n"
+	s += fmt.Sprintf("Content-Length: %d\r\n", len(body))
+	s += "Connection: close\r\n\r\n" + body
+	return []byte(s)
+}
+
+// headerValue returns the value of header name in the request head, or "".
+func headerValue(req, name string) string {
+	end := strings.Index(req, "\r\n\r\n")
+	if end < 0 {
+		end = len(req)
+	}
+	prefix := strings.ToLower(name) + ":"
+	for _, line := range strings.Split(req[:end], "\r\n")[1:] {
+		if strings.HasPrefix(strings.ToLower(line), prefix) {
+			return strings.TrimSpace(line[len(prefix):])
+		}
+	}
+	return ""
+}
+
+// addRouteHeader inserts an X-Goixy-Route header after the status line of
+// the HTTP response starting data. Only the first response of a connection
+// gets it, later ones on a keep-alive connection are not parsed.
+func addRouteHeader(data []byte, route string) []byte {
+	if !bytes.HasPrefix(data, []byte("HTTP/")) {
+		return data
+	}
+	i := bytes.Index(data, []byte("\r\n"))
+	if i < 0 {
+		return data
+	}
+	out := make([]byte, 0, len(data)+32)
+	out = append(out, data[:i+2]...)
+	out = append(out, "X-Goixy-Route: "+route+"\r\n"...)
+	return append(out, data[i+2:]...)
+}
+
+// hasExpectContinue reports whether an HTTP/1.1 request carries
+// "Expect: 100-continue", i.e. the client holds its body back until it
+// sees an interim response.
+func hasExpectContinue(req string) bool {
+	end := strings.Index(req, "\r\n\r\n")
+	if end < 0 {
+		return false
+	}
+	lines := strings.Split(req[:end], "\r\n")
+	if !strings.HasSuffix(lines[0], " HTTP/1.1") {
+		return false
 	}
-	return rhost, rport, key
+	for _, line := range lines[1:] {
+		line = strings.ToLower(line)
+		if strings.HasPrefix(line, "expect:") &&
+			strings.TrimSpace(line[len("expect:"):]) == "100-continue" {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureHostHeader adds a Host header taken from the request URL when the
+// client only put the host in the request line.
+func ensureHostHeader(lg connLog, req, host string) string {
+	end := strings.Index(req, "\r\n\r\n")
+	if end < 0 {
+		// headers not complete in the first read, leave them alone
+		return req
+	}
+	lines := strings.Split(req[:end], "\r\n")
+	for _, line := range lines[1:] {
+		if strings.HasPrefix(strings.ToLower(line), "host:") {
+			return req
+		}
+	}
+	lg.verbose("add missing Host header: %s", host)
+	i := len(lines[0]) + 2
+	return req[:i] + "Host: " + host + "\r\n" + req[i:]
 }
 
-func handleRemote(client net.Conn, shost, sport, rhost, rport string, d2c, d2r, key []byte) {
-	remote, err := net.Dial("tcp", rhost+":"+rport)
+// getRemoteInfo picks the remote for shost, once rewritten by
+// DEST_TRANSFORMS. override is the Route of the listener the client came
+// in on, which replaces the rules when set. It returns false when the
+// destination must be refused (port not in AllowedPorts, by RouteScript,
+// or FailClosed and not in WhiteList).
+func getRemoteInfo(cfg *routerConfig, lg connLog, shost, sport, client_ip string, is_socks bool, override string) (Remote, bool) {
+	dhost, dport := transformDest(cfg, lg, shost, sport)
+	r, ok := routeRemote(cfg, lg, dhost, dport, client_ip, is_socks, override)
+	r.DestHost = dhost
+	r.DestPort = dport
+	r.Override = override
+	return r, ok
+}
+
+func routeRemote(cfg *routerConfig, lg connLog, shost, sport, client_ip string, is_socks bool, override string) (Remote, bool) {
+	if !portAllowed(cfg, sport) {
+		lg.info("port %s is not in AllowedPorts", sport)
+		return Remote{}, false
+	}
+	switch override {
+	case ROUTE_UPSTREAM:
+		return upstreamRemote(cfg, shost, sport), true
+	case ROUTE_DIRECT:
+		// checked at load, but a reload may turn FailClosed on for a
+		// listener opened before
+		if cfg.FailClosed {
+			lg.info("%s:%s from a direct listener, refused with FailClosed", shost, sport)
+			return Remote{}, false
+		}
+		return directRemote(cfg), true
+	}
+	if cfg.routeScript != nil {
+		switch routeByScript(cfg, shost, sport, client_ip) {
+		case ROUTE_UPSTREAM:
+			return upstreamRemote(cfg, shost, sport), true
+		case ROUTE_DIRECT:
+			// DirectHost is optional with RouteScript, and without it the
+			// direct remote would be ":DirectPort" on this host
+			if cfg.DirectHost == "" {
+				lg.warn("%s:%s routed direct by RouteScript, refused without DirectHost", shost, sport)
+				return Remote{}, false
+			}
+			if cfg.FailClosed {
+				lg.info("%s:%s routed direct by RouteScript, refused with FailClosed", shost, sport)
+				return Remote{}, false
+			}
+			return directRemote(cfg), true
+		case ROUTE_BLOCK:
+			return Remote{}, false
+		}
+		// the script failed, fall back to WhiteList
+	}
+
+	keyRoute := shost + ":" + sport
+	route, ok := cfg.routeCache.Get(keyRoute)
+	if !ok {
+		var complete bool
+		route, complete = listRoute(cfg, lg, shost, sport)
+		if complete {
+			cfg.routeCache.Set(keyRoute, route)
+		}
+	}
+	// DirectList entries are exceptions to broader WhiteList patterns,
+	// but FailClosed never goes direct
+	if route == ROUTE_DIRECT {
+		if cfg.FailClosed {
+			lg.info("%s:%s is in DirectList, refused with FailClosed", shost, sport)
+			return Remote{}, false
+		}
+		return directRemote(cfg), true
+	}
+	inList := route == ROUTE_UPSTREAM
+	if cfg.FailClosed && !inList {
+		return Remote{}, false
+	}
+	if is_socks || !WITH_DIRECT || inList {
+		return upstreamRemote(cfg, shost, sport), true
+	}
+	return directRemote(cfg), true
+}
+
+// portAllowed tells if sport is in AllowedPorts; all are when it is empty.
+func portAllowed(cfg *routerConfig, sport string) bool {
+	if len(cfg.AllowedPorts) == 0 {
+		return true
+	}
+	nport, err := strconv.Atoi(sport)
+	if err != nil {
+		return false
+	}
+	for _, p := range cfg.AllowedPorts {
+		if p == nport {
+			return true
+		}
+	}
+	return false
+}
+
+// listRoute matches shost:sport against the rule lists: ROUTE_DIRECT for
+// a DirectList or bypass match, ROUTE_UPSTREAM for a WhiteList match,
+// else "". complete is false when the WhiteList ran out of its
+// WhiteListBudget, so the route must not be cached.
+func listRoute(cfg *routerConfig, lg connLog, shost, sport string) (route string, complete bool) {
+	// NO_PROXY is often set for other tools, so only use it once a
+	// direct proxy is configured
+	if cfg.DirectHost != "" && cfg.bypass.match(normalizeHost(shost)) {
+		return ROUTE_DIRECT, true
+	}
+	if matchRules(cfg.directRules, normalizeHost(shost), sport) {
+		return ROUTE_DIRECT, true
+	}
+	inList, complete := whiteListMatch(cfg, shost, sport)
+	if !complete {
+		lg.warn("WhiteList took over %dms for %s:%s, use the default route",
+			cfg.WhiteListBudget, shost, sport)
+		return "", false
+	}
+	if inList {
+		return ROUTE_UPSTREAM, true
+	}
+	if matchRules(cfg.keyRules, normalizeHost(shost), sport) {
+		return ROUTE_UPSTREAM, true
+	}
+	if cfg.ReverseDNS && ptrInList(cfg, lg, shost, sport) {
+		return ROUTE_UPSTREAM, true
+	}
+	return "", true
+}
+
+// upstreamRemote is Host:Port, with the Key of the first KeyList entry
+// matching shost:sport, or else the global one.
+func upstreamRemote(cfg *routerConfig, shost, sport string) Remote {
+	key := cfg.key
+	if rule, ok := firstRule(cfg.keyRules, normalizeHost(shost), sport); ok {
+		key = rule.Key
+	}
+	r := serverRemote(cfg, pickUpstream(cfg), key)
+	if cfg.FrontDomain != "" || cfg.FrontSNI != "" {
+		r.Front = cfg.FrontDomain
+		r.TLSName = cfg.FrontSNI
+		if r.TLSName == "" {
+			r.TLSName = cfg.FrontDomain
+		}
+	}
+	return r
+}
+
+// serverRemote is the upstream server with key, connected to itself
+// rather than through FrontDomain.
+func serverRemote(cfg *routerConfig, server UpstreamServer, key []byte) Remote {
+	return Remote{
+		Host: server.Host,
+		Port: server.Port,
+		Key:  key,
+		Type: cfg.UpstreamType,
+		User: cfg.UpstreamUser,
+		Pass: cfg.UpstreamPass,
+
+		TLS:         cfg.UpstreamTLS,
+		TLSName:     cfg.UpstreamSNI,
+		TLSInsecure: cfg.UpstreamInsecure,
+		TLSPin:      cfg.upstreamPin,
+
+		Obfuscate:       cfg.Obfuscate,
+		ObfuscateJitter: cfg.ObfuscateJitter,
+		Ack:             cfg.UpstreamAck,
+
+		SendClientIP: cfg.SendClientIP,
+
+		UseProxy: cfg.UpstreamProxy != "",
+
+		Transport: cfg.Transport,
+
+		Route:   ROUTE_UPSTREAM,
+		Metered: server.Metered,
+	}
+}
+
+func directRemote(cfg *routerConfig) Remote {
+	return Remote{Host: cfg.DirectHost, Port: cfg.DirectPort, Key: cfg.directKey, Route: ROUTE_DIRECT,
+		Metered: cfg.DirectMetered}
+}
+
+func handleRemote(cfg *routerConfig, lg connLog, client net.Conn, shost, sport string, r Remote, d2c, d2r []byte, expectContinue, socks, routeHeader bool) {
+	// relays are routed again on reload from the destination asked for
+	askHost, askPort := shost, sport
+	if r.DestHost != "" {
+		shost, sport = r.DestHost, r.DestPort
+	}
+	// the name was routed, the remote only gets its IP
+	name, ip := shost, ""
+	if cfg.ResolveLocally && net.ParseIP(strings.Trim(shost, "[]")) == nil {
+		var err error
+		ip, err = resolveHost(cfg, lg, shost)
+		if err != nil {
+			lg.warn("cannot resolve %s: %v", shost, err)
+			if socks {
+				client.Write(socksReply(4, nil))
+			}
+			return
+		}
+		shost = ip
+	}
+	// the last check before any dial, whatever the route
+	if !destinationAllowed(cfg, name, ip) {
+		lg.warn("refused %s:%s, not in AllowDestinations", name, sport)
+		if socks {
+			// connection not allowed by ruleset
+			client.Write(socksReply(2, nil))
+		}
+		return
+	}
+	rhost, rport, key := r.Host, r.Port, r.Key
+	if r.Route == ROUTE_UPSTREAM && !upstreamAttempt(cfg, rhost, rport) {
+		lg.warn("upstream %s:%s keeps failing, not connecting to it for now", rhost, rport)
+		if socks {
+			client.Write(socksReply(1, nil))
+		}
+		return
+	}
+	remote, err := dialRemote(cfg, r)
 	if err != nil {
-		info("cannot connect to remote: %s:%s", rhost, rport)
+		lg.warn("cannot connect to remote: %s:%s: %v", rhost, rport, err)
+		METRIC_DIAL_FAILURES.Add(1)
+		if r.Route == ROUTE_UPSTREAM {
+			markUpstreamDown(cfg, rhost, rport)
+		}
+		if socks {
+			client.Write(socksReply(1, nil))
+		}
 		return
 	}
+	if r.Route == ROUTE_UPSTREAM {
+		markUpstreamUp(cfg, rhost, rport)
+	}
 	keyServer := fmt.Sprintf("%s:%s", shost, sport)
+	keyClient := clientIP(client)
 	initServers(keyServer, 0)
+	event := WebhookEvent{Host: shost, Port: sport, Route: r.Route, Client: keyClient}
+	ev_open := event
+	ev_open.Event = EVENT_OPEN
+	sendWebhook(cfg, ev_open)
+	started := time.Now()
+	var audit *auditRow
+	if AUDIT != nil {
+		audit = newAuditRow(d2r, socks)
+	}
 	defer func() {
 		remote.Close()
 		deleteServers(fmt.Sprintf("%s:%s", shost, sport))
-		debug("closed remote for %s:%s", shost, sport)
+		lg.debug("closed remote for %s:%s", shost, sport)
+		event.Event = EVENT_CLOSE
+		event.Duration = time.Since(started).Seconds()
+		sendWebhook(cfg, event)
+		sendFlow(cfg, client.RemoteAddr(), event, started)
+		if audit != nil {
+			AUDIT.add(audit.finish(event))
+		}
 	}()
-	debug("connected to remote: %s", remote.RemoteAddr())
-
-	bytesCheck := make([]byte, 8)
-	copy(bytesCheck, key[8:16])
-	bytesCheck = encrypt.Encrypt(bytesCheck, key)
-	remote.Write([]byte{byte(len(bytesCheck))})
-	remote.Write(bytesCheck)
+	lg.debug("connected to remote: %s", remote.RemoteAddr())
+	setSockBufs(remote, cfg.SockRcvBuf, cfg.SockSndBuf)
+	if cfg.ClientSockBuf {
+		setSockBufs(client, cfg.SockRcvBuf, cfg.SockSndBuf)
+	}
+	rl := &relay{lg, askHost, askPort, keyClient, socks, r, remote}
+	trackRelay(rl)
+	defer untrackRelay(rl)
 
-	bytesHost := []byte(shost)
-	bytesHost = encrypt.Encrypt(bytesHost, key)
-	remote.Write([]byte{byte(len(bytesHost))})
-	remote.Write(bytesHost)
+	// socks5 and httpconnect upstreams relay the data as is
+	isRaw := r.Type == UPSTREAM_SOCKS5 || r.Type == UPSTREAM_HTTPCONNECT
+	if r.Type == UPSTREAM_SOCKS5 {
+		err = socks5Handshake(remote, shost, sport, r.User, r.Pass)
+		if err != nil {
+			lg.warn("upstream socks5 %s:%s failed: %v", rhost, rport, err)
+			if socks {
+				// pass on why the upstream refused, so the client can
+				// tell an unresolvable host from a general failure
+				rep := byte(1)
+				if e, ok := err.(*UpstreamReplyError); ok {
+					rep = e.Rep
+				}
+				client.Write(socksReply(rep, nil))
+			}
+			return
+		}
+	} else if r.Type == UPSTREAM_HTTPCONNECT {
+		err = httpConnect(remote, net.JoinHostPort(shost, sport), connectHost(r, shost, sport), connectAuth(r))
+		if err != nil {
+			lg.warn("upstream httpconnect %s:%s failed: %v", rhost, rport, err)
+			if socks {
+				client.Write(socksReply(1, nil))
+			}
+			return
+		}
+	} else {
+		writeHandshake(lg, remote, shost, sport, r, keyClient)
 
-	b := make([]byte, 2)
-	nportServer, _ := strconv.Atoi(sport)
-	binary.BigEndian.PutUint16(b, uint16(nportServer))
-	remote.Write(b)
+		if r.Ack {
+			err = readUpstreamAck(cfg, remote)
+			if err != nil {
+				lg.warn("upstream %s:%s does not speak goixy protocol: %v", rhost, rport, err)
+				if socks {
+					client.Write(socksReply(1, nil))
+				}
+				return
+			}
+		}
+	}
 
 	ch_client := make(chan DataInfo)
-	ch_remote := make(chan []byte)
+	// a client write buffer batches what the reader got ahead with
+	ch_remote := make(chan DataInfo)
+	if cfg.ClientWriteBuffer > 0 {
+		ch_remote = make(chan DataInfo, 16)
+	}
 
+	if socks {
+		handshakeJitter(cfg)
+		client.Write(socksReply(0, advertiseAddr(cfg, remote.LocalAddr())))
+	}
 	if d2c != nil {
 		client.Write(d2c)
 	}
+	// until the remote replies, reads from it are bounded by
+	// FirstByteTimeout, counted from the first data sent to it
+	first_byte := time.Second * time.Duration(cfg.FirstByteTimeout)
+	awaiting := first_byte > 0
+	armed := false
 	if d2r != nil {
-		remote.Write(d2r)
+		if awaiting {
+			remote.SetReadDeadline(time.Now().Add(first_byte))
+			armed = true
+		}
+		METRIC_BYTES_UP.Add(int64(len(d2r)))
+		event.BytesUp += int64(len(d2r))
+		countMetered(r, len(d2r))
+		if isRaw {
+			remote.Write(d2r)
+		} else {
+			writeFrame(remote, d2r, r)
+		}
+	}
+
+	go readDataFromClient(lg, ch_client, ch_remote, client)
+	if isRaw {
+		go readRawDataFromRemote(lg, ch_remote, remote, shost, sport)
+	} else {
+		go readDataFromRemote(lg, ch_remote, remote, shost, sport, key, r.Obfuscate)
 	}
+	defer func() {
+		// take what the readers still hand over once the relay ended, so
+		// they finish and give back their BufferBudget
+		go func() {
+			for di := range ch_remote {
+				BUFFER_BUDGET.release(di.hold)
+			}
+		}()
+		go func() {
+			for di := range ch_client {
+				BUFFER_BUDGET.release(di.hold)
+			}
+		}()
+	}()
 
-	go readDataFromClient(ch_client, ch_remote, client)
-	go readDataFromRemote(ch_remote, remote, shost, sport, key)
+	// The interim response from the origin is relayed like any other data.
+	// If the origin stays silent (e.g. it only speaks HTTP/1.0), answer
+	// the client ourselves so it starts sending the body.
+	var ch_continue <-chan time.Time
+	if expectContinue {
+		ch_continue = time.After(time.Second)
+	}
+	var ch_lifetime <-chan time.Time
+	if cfg.MaxConnLifetime > 0 {
+		ch_lifetime = time.After(time.Second * time.Duration(cfg.MaxConnLifetime))
+	}
+	// the idle timeout is reset by data in either direction only, not by
+	// our own keepalives
+	span_timeout := time.Second * time.Duration(SPAN_TIMEOUT)
+	idle := time.NewTimer(span_timeout)
+	defer idle.Stop()
+	var ch_keepalive <-chan time.Time
+	keepalive := time.Second * time.Duration(cfg.KeepAlive)
+	if cfg.KeepAlive > 0 && !isRaw {
+		ticker := time.NewTicker(keepalive)
+		defer ticker.Stop()
+		ch_keepalive = ticker.C
+	}
+	last_sent := time.Now()
+	nodelay := newAdaptiveNoDelay(cfg.NoDelayThreshold, client, remote)
+	// with ClientWriteBuffer, data for the client is batched into fewer
+	// writes, flushed when full or when the remote has no more ready
+	var client_w io.Writer = client
+	var client_buf *bufio.Writer
+	if cfg.ClientWriteBuffer > 0 {
+		client_buf = bufio.NewWriterSize(client, cfg.ClientWriteBuffer)
+		client_w = client_buf
+		defer client_buf.Flush()
+	}
+	var coalescer *frameCoalescer
+	if cfg.CoalesceDelay > 0 && !isRaw {
+		coalescer = newFrameCoalescer(cfg)
+	}
 
 	for {
 		select {
-		case data, ok := <-ch_remote:
-			if !ok {
-				return
+		case di, ok := <-ch_remote:
+			for {
+				if !ok {
+					if awaiting && armed {
+						lg.warn("no reply from remote for %s:%s within %v", shost, sport, first_byte)
+					}
+					return
+				}
+				BUFFER_BUDGET.release(di.hold)
+				data := di.data
+				if awaiting {
+					awaiting = false
+					if armed {
+						remote.SetReadDeadline(time.Time{})
+					}
+				}
+				resetTimer(idle, span_timeout)
+				if ch_continue != nil && bytes.HasPrefix(data, []byte("HTTP/1.1 1")) {
+					lg.debug("relay interim response for %s:%s", shost, sport)
+				}
+				ch_continue = nil
+				if audit != nil {
+					audit.response(data)
+				}
+				if routeHeader && !bytes.HasPrefix(data, []byte("HTTP/1.1 1")) {
+					data = addRouteHeader(data, r.Route)
+					routeHeader = false
+				}
+				incrClients(keyClient, int64(len(data)))
+				event.BytesDown += int64(len(data))
+				countMetered(r, len(data))
+				if nodelay.add(len(data)) {
+					lg.debug("bulk transfer on %s:%s, disable TCP_NODELAY", shost, sport)
+				}
+				if _, err := client_w.Write(data); err != nil {
+					lg.info("client broke while relaying %s:%s: %v", shost, sport, err)
+					return
+				}
+				if client_buf == nil || client_buf.Buffered() == 0 {
+					break
+				}
+				// keep batching while the remote has more ready, and flush
+				// once it is idle
+				select {
+				case di, ok = <-ch_remote:
+					continue
+				default:
+				}
+				if err := client_buf.Flush(); err != nil {
+					lg.info("client broke while relaying %s:%s: %v", shost, sport, err)
+					return
+				}
+				break
+			}
+		case <-ch_continue:
+			lg.debug("no interim response from %s:%s, send 100 Continue", shost, sport)
+			ch_continue = nil
+			client_w.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+			if client_buf != nil {
+				client_buf.Flush()
 			}
-			client.Write(data)
 		case di, ok := <-ch_client:
 			if !ok {
+				coalescer.flush(remote, r)
+				return
+			}
+			BUFFER_BUDGET.release(di.hold)
+			ch_continue = nil
+			resetTimer(idle, span_timeout)
+			if audit != nil {
+				if next := audit.next(di.data[:di.size], event); next != nil {
+					AUDIT.add(audit.finish(event))
+					audit = next
+				}
+			}
+			incrClients(keyClient, int64(di.size))
+			touchServers(keyServer)
+			event.BytesUp += int64(di.size)
+			countMetered(r, di.size)
+			if nodelay.add(di.size) {
+				lg.debug("bulk transfer on %s:%s, disable TCP_NODELAY", shost, sport)
+			}
+			if awaiting && !armed {
+				remote.SetReadDeadline(time.Now().Add(first_byte))
+				armed = true
+			}
+			if isRaw {
+				_, err = remote.Write(di.data[:di.size])
+			} else if coalescer != nil {
+				err = coalescer.add(remote, r, di.data[:di.size])
+			} else {
+				err = writeFrame(remote, di.data[:di.size], r)
+			}
+			if err != nil {
+				lg.info("remote broke while relaying %s:%s: %v", shost, sport, err)
 				return
 			}
-			buffer := encrypt.Encrypt(di.data[:di.size], key)
-			b := make([]byte, 2)
-			binary.BigEndian.PutUint16(b, uint16(len(buffer)))
-			remote.Write(b)
-			remote.Write(buffer)
-		case <-time.After(time.Second * time.Duration(SPAN_TIMEOUT)):
-			debug("timeout on %s:%s", shost, sport)
+			last_sent = time.Now()
+		case <-coalescer.timer():
+			if err := coalescer.flush(remote, r); err != nil {
+				lg.info("remote broke while relaying %s:%s: %v", shost, sport, err)
+				return
+			}
+		case <-ch_keepalive:
+			if time.Since(last_sent) >= keepalive {
+				lg.verbose("send keepalive to %s:%s", shost, sport)
+				if _, err := remote.Write([]byte{0, 0}); err != nil {
+					lg.info("remote broke while relaying %s:%s: %v", shost, sport, err)
+					return
+				}
+				last_sent = time.Now()
+			}
+		case <-idle.C:
+			lg.debug("timeout on %s:%s", shost, sport)
+			return
+		case <-ch_lifetime:
+			lg.info("max lifetime reached, force close %s:%s", shost, sport)
 			return
 		}
 	}
 }
 
-func readDataFromClient(ch chan DataInfo, ch2 chan []byte, conn net.Conn) {
+// writeHandshake sends the lightsocks handshake for shost:sport, encrypted
+// with r.Key, and the client IP when r.SendClientIP is set.
+func writeHandshake(lg connLog, remote net.Conn, shost, sport string, r Remote, keyClient string) {
+	bytesCheck := make([]byte, 8)
+	copy(bytesCheck, r.Key[8:16])
+	bytesCheck = encrypt.Encrypt(bytesCheck, r.Key)
+	remote.Write([]byte{byte(len(bytesCheck))})
+	remote.Write(bytesCheck)
+	lg.trace("[%s:%s] handshake check bytes (%d):\n%s", shost, sport, len(bytesCheck), hex.Dump(bytesCheck))
+
+	bytesHost := []byte(shost)
+	bytesHost = encrypt.Encrypt(bytesHost, r.Key)
+	remote.Write([]byte{byte(len(bytesHost))})
+	remote.Write(bytesHost)
+	lg.trace("[%s:%s] handshake host (%d):\n%s", shost, sport, len(bytesHost), hex.Dump(bytesHost))
+
+	b := make([]byte, 2)
+	nportServer, _ := strconv.Atoi(sport)
+	binary.BigEndian.PutUint16(b, uint16(nportServer))
+	remote.Write(b)
+	lg.trace("[%s:%s] handshake port: %x", shost, sport, b)
+
+	if r.SendClientIP {
+		// an extension for servers that expect it: the client IP,
+		// encrypted like the host
+		bytesIP := encrypt.Encrypt([]byte(keyClient), r.Key)
+		remote.Write([]byte{byte(len(bytesIP))})
+		remote.Write(bytesIP)
+		lg.trace("[%s:%s] handshake client ip (%d):\n%s", shost, sport, len(bytesIP), hex.Dump(bytesIP))
+	}
+}
+
+// readUpstreamAck waits for the empty frame an UpstreamAck server sends
+// once it accepted the handshake. Anything else, like the reply of a plain
+// HTTP server, means Host:Port is not a goixy/lightsocks server.
+func readUpstreamAck(cfg *routerConfig, remote net.Conn) error {
+	timeout := UPSTREAM_ACK_TIMEOUT
+	if cfg.FirstByteTimeout > 0 {
+		timeout = time.Second * time.Duration(cfg.FirstByteTimeout)
+	}
+	remote.SetReadDeadline(time.Now().Add(timeout))
+	defer remote.SetReadDeadline(time.Time{})
+	b := make([]byte, 2)
+	n, err := io.ReadFull(remote, b)
+	if err != nil {
+		return fmt.Errorf("no ack (got %q): %v", b[:n], err)
+	}
+	if b[0] != 0 || b[1] != 0 {
+		return fmt.Errorf("bad ack %q", b)
+	}
+	return nil
+}
+
+// resetTimer restarts t for d, dropping a pending expiry.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// the most plaintext put in one frame, leaving room under the 2-byte
+// length for the encryption overhead and the Obfuscate padding
+const MAX_FRAME_DATA = 32768
+
+// writeFrame sends data as encrypted frames, split so that none outgrows
+// its 2-byte length.
+func writeFrame(remote net.Conn, data []byte, r Remote) error {
+	for len(data) > MAX_FRAME_DATA {
+		if err := writeOneFrame(remote, data[:MAX_FRAME_DATA], r); err != nil {
+			return err
+		}
+		data = data[MAX_FRAME_DATA:]
+	}
+	return writeOneFrame(remote, data, r)
+}
+
+func writeOneFrame(remote net.Conn, data []byte, r Remote) error {
+	if r.Obfuscate {
+		data = padFrame(data)
+		frameJitter(r.ObfuscateJitter)
+	}
+	buffer := encrypt.Encrypt(data, r.Key)
+	if len(buffer) > 0xffff {
+		// a truncated length would corrupt the rest of the stream
+		return fmt.Errorf("encrypted frame of %d bytes exceeds the 2-byte length", len(buffer))
+	}
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(len(buffer)))
+	if _, err := remote.Write(b); err != nil {
+		return err
+	}
+	_, err := remote.Write(buffer)
+	return err
+}
+
+func readDataFromClient(lg connLog, ch chan DataInfo, ch2 chan DataInfo, conn net.Conn) {
 	for {
 		data := make([]byte, 8192)
 		n, err := conn.Read(data)
+		if n > 0 {
+			// released by handleRemote once relayed
+			hold := BUFFER_BUDGET.acquire(n)
+			lg.debug("received %d bytes from client", n)
+			METRIC_BYTES_UP.Add(int64(n))
+			lg.verbose("client: %s", data[:n])
+			ch <- DataInfo{data, n, hold}
+		}
+		if err != nil && os.IsTimeout(err) {
+			// only a read deadline passed: the idle timeout and max
+			// lifetime are up to handleRemote, so clear it and go on
+			lg.debug("read deadline on client, continue: %v", err)
+			conn.SetReadDeadline(time.Time{})
+			continue
+		}
 		if err != nil {
 			close(ch)
 			break
 		}
-		debug("received %d bytes from client", n)
-		verbose("client: %s", data[:n])
-		ch <- DataInfo{data, n}
 	}
 }
 
-func readDataFromRemote(ch chan []byte, conn net.Conn, shost, sport string, key []byte) {
+func readDataFromRemote(lg connLog, ch chan DataInfo, conn net.Conn, shost, sport string, key []byte, obfuscate bool) {
+	first := true
 	for {
 		buffer := make([]byte, 2)
-		_, err := io.ReadFull(conn, buffer)
+		n, err := io.ReadFull(conn, buffer)
+		if err == io.EOF {
+			lg.debug("[%s:%s] remote closed", shost, sport)
+			break
+		}
 		if err != nil {
+			logRemoteReadError(lg, shost, sport, n, 2, err)
 			break
 		}
 		size := binary.BigEndian.Uint16(buffer)
+		if first {
+			lg.trace("[%s:%s] first frame length: %x (%d)", shost, sport, buffer, size)
+		}
+		if size == 0 {
+			// keepalive frame
+			lg.verbose("[%s:%s] got keepalive", shost, sport)
+			continue
+		}
 
 		keyServer := fmt.Sprintf("%s:%s", shost, sport)
 		incrServers(keyServer, int64(size))
 
 		buffer = make([]byte, size)
-		_, err = io.ReadFull(conn, buffer)
+		n, err = io.ReadFull(conn, buffer)
 		if err != nil {
+			logRemoteReadError(lg, shost, sport, n, int(size), err)
 			break
 		}
+		if first {
+			lg.trace("[%s:%s] first frame:\n%s", shost, sport, hex.Dump(buffer[:minInt(len(buffer), 64)]))
+			first = false
+		}
 		data, err := encrypt.Decrypt(buffer, key)
 		if err != nil {
-			info("ERROR: cannot decrypt data from client")
+			lg.logError("ERROR: cannot decrypt data from client")
+			METRIC_DECRYPT_ERRORS.Add(1)
 			break
 		}
+		if obfuscate {
+			data, err = unpadFrame(data)
+			if err != nil {
+				lg.logError("ERROR: %v", err)
+				break
+			}
+		}
+		// released by handleRemote once relayed
+		hold := BUFFER_BUDGET.acquire(len(data))
 		n_bytes := len(data)
-		debug("[%s:%s] received %d bytes", shost, sport, n_bytes)
+		lg.debug("[%s:%s] received %d bytes", shost, sport, n_bytes)
 		MUTEX.Lock()
 		TOTAL_BYTES += int64(n_bytes)
 		MUTEX.Unlock()
-		verbose("remote: %s", data)
-		ch <- data
+		METRIC_BYTES_DOWN.Add(int64(n_bytes))
+		lg.verbose("remote: %s", data)
+		ch <- DataInfo{data, n_bytes, hold}
+	}
+	close(ch)
+}
+
+// logRemoteReadError tells a stream cut in the middle of a frame (got n
+// of size bytes), which means the server crashed or the keys differ, from
+// other read errors such as a reset.
+func logRemoteReadError(lg connLog, shost, sport string, n, size int, err error) {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		lg.warn("[%s:%s] truncated frame from remote: got %d of %d bytes", shost, sport, n, size)
+		METRIC_TRUNCATED_FRAMES.Add(1)
+		return
+	}
+	lg.debug("[%s:%s] read from remote: %v", shost, sport, err)
+}
+
+func readRawDataFromRemote(lg connLog, ch chan DataInfo, conn net.Conn, shost, sport string) {
+	keyServer := fmt.Sprintf("%s:%s", shost, sport)
+	for {
+		data := make([]byte, 8192)
+		n, err := conn.Read(data)
+		if err != nil {
+			break
+		}
+		// released by handleRemote once relayed
+		hold := BUFFER_BUDGET.acquire(n)
+		incrServers(keyServer, int64(n))
+		lg.debug("[%s:%s] received %d bytes", shost, sport, n)
+		MUTEX.Lock()
+		TOTAL_BYTES += int64(n)
+		MUTEX.Unlock()
+		METRIC_BYTES_DOWN.Add(int64(n))
+		lg.verbose("remote: %s", data[:n])
+		ch <- DataInfo{data[:n], n, hold}
 	}
 	close(ch)
 }
@@ -424,13 +1682,45 @@ func loadDirects() []byte {
 	return sum[:]
 }
 
-func getRouterConfig() []byte {
+// configPath returns the config file found by findConfigFile at startup.
+func configPath() string {
+	return CONFIG_FILE
+}
+
+// findConfigFile returns file (the -config flag), or else the first
+// existing one of config.json, config.yaml and config.yml in
+// $XDG_CONFIG_HOME/goixy (default ~/.config/goixy), then in ~/.goixy. It
+// runs once, before -user drops the privileges, so that reloads read the
+// same file rather than one in the home of the new user.
+func findConfigFile(file string) string {
+	if file != "" {
+		if abs, err := filepath.Abs(file); err == nil {
+			return abs
+		}
+		return file
+	}
 	usr, err := user.Current()
 	if err != nil {
 		fmt.Printf("user current: %v\n", err)
 		os.Exit(2)
 	}
-	fileConfig := path.Join(usr.HomeDir, ".goixy/config.json")
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	if xdg == "" {
+		xdg = path.Join(usr.HomeDir, ".config")
+	}
+	for _, dir := range []string{path.Join(xdg, "goixy"), path.Join(usr.HomeDir, ".goixy")} {
+		for _, name := range []string{"config.json", "config.yaml", "config.yml"} {
+			fileConfig := path.Join(dir, name)
+			if _, err := os.Stat(fileConfig); err == nil {
+				return fileConfig
+			}
+		}
+	}
+	return path.Join(usr.HomeDir, ".goixy/config.json")
+}
+
+func getRouterConfig() []byte {
+	fileConfig := configPath()
 	if _, err := os.Stat(fileConfig); os.IsNotExist(err) {
 		fmt.Printf("config file is missing: %v\n", fileConfig)
 		os.Exit(2)
@@ -444,22 +1734,109 @@ func getRouterConfig() []byte {
 	return data
 }
 
-func info(format string, a ...interface{}) {
+// connLog logs for one client connection, prefixing its ID so that the
+// lines of concurrent connections can be told apart.
+type connLog string
+
+var CONN_ID uint64 = 0
+
+func newConnLog() connLog {
+	return connLog(fmt.Sprintf("#%d", atomic.AddUint64(&CONN_ID, 1)))
+}
+
+func (lg connLog) logf(level int, format string, a ...interface{}) {
+	logf(level, "["+string(lg)+"] "+format, a...)
+}
+
+func (lg connLog) logError(format string, a ...interface{}) {
+	lg.logf(LOG_ERROR, format, a...)
+}
+
+func (lg connLog) warn(format string, a ...interface{}) {
+	lg.logf(LOG_WARN, format, a...)
+}
+
+func (lg connLog) info(format string, a ...interface{}) {
+	lg.logf(LOG_INFO, format, a...)
+}
+
+func (lg connLog) debug(format string, a ...interface{}) {
+	lg.logf(LOG_DEBUG, format, a...)
+}
+
+func (lg connLog) verbose(format string, a ...interface{}) {
+	lg.logf(LOG_VERBOSE, format, a...)
+}
+
+func (lg connLog) trace(format string, a ...interface{}) {
+	lg.logf(LOG_TRACE, format, a...)
+}
+
+func logf(level int, format string, a ...interface{}) {
+	if int32(level) > atomic.LoadInt32(&LOG_LEVEL) {
+		return
+	}
 	ts := time.Now().Format("2006-01-02 15:04:05")
-	prefix := fmt.Sprintf("[%s][%d] ", ts, COUNT_CONNECTED)
+	prefix := fmt.Sprintf("[%s][%d] ", ts, atomic.LoadInt64(&COUNT_CONNECTED))
 	fmt.Printf(prefix+format+"\n", a...)
 }
 
+func logError(format string, a ...interface{}) {
+	logf(LOG_ERROR, format, a...)
+}
+
+func warn(format string, a ...interface{}) {
+	logf(LOG_WARN, format, a...)
+}
+
+func info(format string, a ...interface{}) {
+	logf(LOG_INFO, format, a...)
+}
+
 func debug(format string, a ...interface{}) {
-	if DEBUG || VERBOSE {
-		info(format, a...)
-	}
+	logf(LOG_DEBUG, format, a...)
 }
 
 func verbose(format string, a ...interface{}) {
-	if VERBOSE {
-		info(format, a...)
+	logf(LOG_VERBOSE, format, a...)
+}
+
+func trace(format string, a ...interface{}) {
+	logf(LOG_TRACE, format, a...)
+}
+
+// parseLogLevel maps a LogLevel name to its level; "" is info.
+func parseLogLevel(name string) (int, error) {
+	if name == "" {
+		return LOG_INFO, nil
+	}
+	for level, s := range LOG_LEVEL_NAMES {
+		if s == strings.ToLower(name) {
+			return level, nil
+		}
 	}
+	return 0, fmt.Errorf("Invalid LogLevel: %s", name)
+}
+
+// cycleLogLevel moves the log level on to the next of info, debug and
+// trace, then back to info.
+func cycleLogLevel() {
+	level := LOG_INFO
+	switch current := int(atomic.LoadInt32(&LOG_LEVEL)); {
+	case current < LOG_DEBUG:
+		level = LOG_DEBUG
+	case current < LOG_TRACE:
+		level = LOG_TRACE
+	}
+	atomic.StoreInt32(&LOG_LEVEL, int32(level))
+	logf(LOG_ERROR, "log level set to %s", LOG_LEVEL_NAMES[level])
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
 }
 
 func byteInArray(b byte, A []byte) bool {
@@ -472,22 +1849,115 @@ func byteInArray(b byte, A []byte) bool {
 }
 
 func printServersInfo() {
+	PREV_REPORT_TIME = time.Now()
 	for {
 		select {
 		case <-time.After(time.Second * time.Duration(SPAN_REPORT)):
+			pruneServers()
 			doPrintServersInfo()
 		}
 	}
 }
 
 func doPrintServersInfo() {
+	lines := append(serversReport(), topTalkersReport()...)
+	for _, line := range append(lines, clientsReport()...) {
+		info("%s", line)
+	}
+}
+
+// the bytes of each destination at the previous report, to tell the
+// current rates of the top talkers
+var PREV_SERVER_BYTES = map[string]int64{}
+var PREV_REPORT_TIME time.Time
+
+type talker struct {
+	key   string
+	delta int64
+}
+
+// topTalkersReport lists the TopTalkers (default 5, negative for none)
+// destinations that moved the most since the previous report, with
+// their rate over that span. Only the periodic report calls it, as it
+// takes the next snapshot.
+func topTalkersReport() []string {
+	cfg := currentConfig()
+	MUTEX.Lock()
+	defer MUTEX.Unlock()
+
+	now := time.Now()
+	current := map[string]int64{}
+	talkers := []talker{}
+	for _, key := range SERVER_INFO.Keys() {
+		m, ok := SERVER_INFO.Get(key)
+		if !ok {
+			continue
+		}
+		tmp, ok := m.(cmap.ConcurrentMap).Get("bytes")
+		if !ok {
+			continue
+		}
+		bytes := tmp.(int64)
+		current[key] = bytes
+		delta := bytes - PREV_SERVER_BYTES[key]
+		if delta < 0 {
+			// the entry was dropped and made again since
+			delta = bytes
+		}
+		if delta > 0 {
+			talkers = append(talkers, talker{key, delta})
+		}
+	}
+	span := now.Sub(PREV_REPORT_TIME).Seconds()
+	PREV_SERVER_BYTES = current
+	PREV_REPORT_TIME = now
+
+	n := cfg.TopTalkers
+	if n == 0 {
+		n = 5
+	}
+	if n < 0 || span <= 0 || len(talkers) == 0 {
+		return nil
+	}
+	sort.Slice(talkers, func(i, j int) bool {
+		return talkers[i].delta > talkers[j].delta
+	})
+	if len(talkers) > n {
+		talkers = talkers[:n]
+	}
+	lines := []string{fmt.Sprintf("[REPORT] top talkers over the last %s:", fmtTimeSpan(int64(span)))}
+	for i, t := range talkers {
+		rate := fmtHumanBytes(int64(float64(t.delta) / span))
+		lines = append(lines, fmt.Sprintf("[REPORT] [top %d] %s: %s/s", i+1, t.key, rate))
+	}
+	return lines
+}
+
+func serversReport() []string {
+	cfg := currentConfig()
 	MUTEX.Lock()
 	defer MUTEX.Unlock()
 
+	lines := []string{}
 	ts_now := time.Now().Unix()
 	keys := SERVER_INFO.Keys()
 	total_bytes := fmtHumanBytes(TOTAL_BYTES)
-	info("[REPORT] %d connections and %s bytes", len(keys), total_bytes)
+	lines = append(lines, fmt.Sprintf("[REPORT] %d connections and %s bytes", len(keys), total_bytes))
+	if len(SOCKS_ERRORS) > 0 {
+		stages := []string{}
+		for stage, n := range SOCKS_ERRORS {
+			stages = append(stages, fmt.Sprintf("%s=%d", stage, n))
+		}
+		sort.Strings(stages)
+		lines = append(lines, "[REPORT] socks errors: "+strings.Join(stages, " "))
+	}
+	if metered := METRIC_BYTES_METERED.Value(); metered > 0 {
+		lines = append(lines, fmt.Sprintf("[REPORT] metered %s, unmetered %s",
+			fmtHumanBytes(metered), fmtHumanBytes(METRIC_BYTES_UNMETERED.Value())))
+	}
+	if unmatched := unmatchedRules(cfg.whiteRules); len(unmatched) > 0 {
+		lines = append(lines, "[REPORT] WhiteList entries never matched: "+strings.Join(unmatched, " "))
+	}
 	for i, key := range keys {
 		if tmp, ok := SERVER_INFO.Get(key); ok {
 			bytes := int64(0)
@@ -508,9 +1978,10 @@ func doPrintServersInfo() {
 			if conn_count > 1 {
 				str_conn_count = fmt.Sprintf("(%d)", conn_count)
 			}
-			info("[REPORT] [%d][%s] %s%s: %s", i, str_span, key, str_conn_count, str_bytes)
+			lines = append(lines, fmt.Sprintf("[REPORT] [%d][%s] %s%s: %s", i, str_span, key, str_conn_count, str_bytes))
 		}
 	}
+	return lines
 }
 
 func initServers(key string, bytes int64) {
@@ -521,16 +1992,42 @@ func initServers(key string, bytes int64) {
 		if tmp, ok := m.(cmap.ConcurrentMap).Get("count"); ok {
 			m.(cmap.ConcurrentMap).Set("count", tmp.(int64) + 1)
 		}
+		m.(cmap.ConcurrentMap).Set("last", time.Now().Unix())
 	} else {
 		m := cmap.New()
 		now := time.Now()
 		m.Set("count", int64(1))
 		m.Set("bytes", bytes)
 		m.Set("ts", now.Unix())
+		m.Set("last", now.Unix())
 		SERVER_INFO.Set(key, m)
 	}
 }
 
+// pruneServers drops the Servers entries without data either way for
+// ServersTTL seconds (default the -t timeout). Their connections would
+// have timed out, so such entries are only left over by a missed
+// deleteServers.
+func pruneServers() {
+	cfg := currentConfig()
+	MUTEX.Lock()
+	defer MUTEX.Unlock()
+
+	ttl := cfg.ServersTTL
+	if ttl <= 0 {
+		ttl = SPAN_TIMEOUT
+	}
+	ts_now := time.Now().Unix()
+	for _, key := range SERVER_INFO.Keys() {
+		if m, ok := SERVER_INFO.Get(key); ok {
+			if tmp, ok := m.(cmap.ConcurrentMap).Get("last"); ok && ts_now-tmp.(int64) > ttl {
+				debug("prune stale server entry %s", key)
+				SERVER_INFO.Remove(key)
+			}
+		}
+	}
+}
+
 func incrServers(key string, n int64) {
 	MUTEX.Lock()
 	defer MUTEX.Unlock()
@@ -539,6 +2036,19 @@ func incrServers(key string, n int64) {
 		if tmp, ok := m.(cmap.ConcurrentMap).Get("bytes"); ok {
 			m.(cmap.ConcurrentMap).Set("bytes", tmp.(int64)+n)
 		}
+		m.(cmap.ConcurrentMap).Set("last", time.Now().Unix())
+	}
+}
+
+// touchServers marks the entry of key active without counting bytes, as
+// Servers only counts the bytes from the remote but an upload is activity
+// all the same.
+func touchServers(key string) {
+	MUTEX.Lock()
+	defer MUTEX.Unlock()
+
+	if m, ok := SERVER_INFO.Get(key); ok {
+		m.(cmap.ConcurrentMap).Set("last", time.Now().Unix())
 	}
 }
 
@@ -563,34 +2073,324 @@ func loadRouterConfig() {
 	if b == nil {
 		return
 	}
-	err := json.Unmarshal(b, &GC)
+	err := applyRouterConfig(b)
 	if err != nil {
-		fmt.Printf("Invalid Goixy Config: %v\n", err)
+		fmt.Printf("%v\n", err)
 		os.Exit(2)
 	}
+}
+
+// reloadRouterConfig loads the config file again, on SIGHUP. If it is
+// invalid the running config is kept.
+func reloadRouterConfig() {
+	b, err := ioutil.ReadFile(configPath())
+	if err == nil {
+		err = applyRouterConfig(b)
+	}
+	if err != nil {
+		logError("reload failed, keeping the old config: %v", err)
+		return
+	}
+	info("config reloaded from %s", configPath())
+	if currentConfig().ReloadDrain {
+		drainChangedRoutes()
+	}
+}
+
+// applyRouterConfig decodes and checks the config in b, and only when all
+// of it is valid makes it the running config.
+func applyRouterConfig(b []byte) error {
+	ext := strings.ToLower(path.Ext(configPath()))
+	if ext == ".yaml" || ext == ".yml" {
+		var err error
+		b, err = yamlToJSON(b)
+		if err != nil {
+			return fmt.Errorf("Invalid Goixy Config: %v", err)
+		}
+	} else {
+		b = stripJSONC(b)
+	}
+	gc := GoixyConfig{}
+	err := json.Unmarshal(b, &gc)
+	if err != nil {
+		return fmt.Errorf("Invalid Goixy Config: %v", err)
+	}
+
+	if gc.UpstreamType != "" && gc.UpstreamType != UPSTREAM_LIGHTSOCKS &&
+		gc.UpstreamType != UPSTREAM_SOCKS5 && gc.UpstreamType != UPSTREAM_HTTPCONNECT {
+		return fmt.Errorf("Invalid UpstreamType: %s", gc.UpstreamType)
+	}
+	if (gc.FrontDomain != "" || gc.FrontSNI != "") &&
+		(gc.UpstreamType != UPSTREAM_HTTPCONNECT || !gc.UpstreamTLS) {
+		return fmt.Errorf("FrontDomain and FrontSNI need UpstreamTLS with UpstreamType httpconnect")
+	}
+	if gc.DoHURL != "" {
+		u, err := url.Parse(gc.DoHURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("Invalid DoHURL: %s", gc.DoHURL)
+		}
+	}
+	err = checkListen(gc)
+	if err != nil {
+		return err
+	}
+	if gc.Transport != "" && gc.Transport != TRANSPORT_TCP &&
+		gc.Transport != TRANSPORT_KCP {
+		return fmt.Errorf("Invalid Transport: %s", gc.Transport)
+	}
+	if gc.Transport == TRANSPORT_KCP && (gc.UpstreamProxy != "" || gc.LocalAddr != "") {
+		return fmt.Errorf("UpstreamProxy and LocalAddr cannot be used with Transport kcp")
+	}
+	err = checkUpstreams(gc.Upstreams)
+	if err != nil {
+		return err
+	}
+	if gc.UpstreamSelect != "" && gc.UpstreamSelect != UPSTREAM_SELECT_WEIGHT &&
+		gc.UpstreamSelect != UPSTREAM_SELECT_LATENCY {
+		return fmt.Errorf("Invalid UpstreamSelect: %s", gc.UpstreamSelect)
+	}
+	if gc.CoalesceSize < 0 || gc.CoalesceSize > MAX_COALESCE_SIZE {
+		return fmt.Errorf("Invalid CoalesceSize: %d, must be at most %d", gc.CoalesceSize, MAX_COALESCE_SIZE)
+	}
+
+	logLevel, err := parseLogLevel(gc.LogLevel)
+	if err != nil {
+		return err
+	}
+	// the -v flags only ever raise the level
+	if FLAG_LOG_LEVEL > logLevel {
+		logLevel = FLAG_LOG_LEVEL
+	}
+
+	lines, err := readRuleFiles(gc.WhiteListFiles, path.Dir(configPath()))
+	if err != nil {
+		return fmt.Errorf("Invalid WhiteListFiles: %v", err)
+	}
+	gc.WhiteList = append(gc.WhiteList, lines...)
+	whiteRules, err := compileRules("WhiteList", gc.WhiteList)
+	if err != nil {
+		return err
+	}
+	blackRules, err := compileRules("BlackList", gc.BlackList)
+	if err != nil {
+		return err
+	}
+	if len(gc.DirectList) > 0 && gc.DirectHost == "" {
+		return fmt.Errorf("Invalid DirectList: needs DirectHost")
+	}
+	directRules, err := compileRules("DirectList", gc.DirectList)
+	if err != nil {
+		return err
+	}
+	keyRules, err := compileKeyRules(gc.KeyList)
+	if err != nil {
+		return err
+	}
+	rewriteRules, err := compileRewriteRules(gc.Rewrite)
+	if err != nil {
+		return err
+	}
+	// a plain host shares the hit counter of its rule, and so does a
+	// domain rule, which is then left out of the regexes
+	whiteHosts := map[string]*uint64{}
+	whiteDomains := map[string]*uint64{}
+	whiteRegexes := []Rule{}
+	for i, s := range gc.WhiteList {
+		if RE_PLAIN_HOST.MatchString(s) {
+			whiteHosts[s] = whiteRules[i].Hits
+		}
+		if domain, ok := ruleDomain(whiteRules[i]); ok {
+			whiteDomains[domain] = whiteRules[i].Hits
+			continue
+		}
+		whiteRegexes = append(whiteRegexes, whiteRules[i])
+	}
+
+	authUsers, err := loadAuthFile(gc.AuthFile)
+	if err != nil {
+		return err
+	}
+	authTrusted, err := parseAuthTrusted(gc.AuthTrusted)
+	if err != nil {
+		return err
+	}
+	flowAddr, err := resolveFlowCollector(gc.FlowCollector)
+	if err != nil {
+		return err
+	}
+	var allowDestinations *BypassList
+	if len(gc.AllowDestinations) > 0 {
+		allowDestinations = parseHostList(gc.AllowDestinations)
+	}
+	script, err := loadRouteScript(gc.RouteScript)
+	if err != nil {
+		return err
+	}
+	dialer := &net.Dialer{}
+	if gc.LocalAddr != "" {
+		ip := net.ParseIP(gc.LocalAddr)
+		if ip == nil {
+			return fmt.Errorf("Invalid LocalAddr: %s", gc.LocalAddr)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	advertise, err := parseAdvertiseAddr(gc.AdvertiseAddr)
+	if err != nil {
+		return err
+	}
+	pin, err := parseCertPin(gc.UpstreamPin)
+	if err != nil {
+		return err
+	}
+	upstreamDialer, err := loadUpstreamProxy(gc.UpstreamProxy, dialer)
+	if err != nil {
+		return err
+	}
 
 	// init keys
-	s := strings.TrimSpace(GC.Key)
+	s := strings.TrimSpace(gc.Key)
 	_tmp := sha256.Sum256([]byte(s))
-	KEY = _tmp[:]
-	if GC.DirectKey != "" {
-		s = strings.TrimSpace(GC.DirectKey)
+	key := _tmp[:]
+	directKey := key
+	if gc.DirectKey != "" {
+		s = strings.TrimSpace(gc.DirectKey)
 		_tmp = sha256.Sum256([]byte(s))
-		DIRECT_KEY = _tmp[:]
-	} else {
-		DIRECT_KEY = KEY
+		directKey = _tmp[:]
+	}
+
+	// opened last, so that a load failing after it cannot leak it
+	flowConn, err := openFlowConn(flowAddr)
+	if err != nil {
+		return err
+	}
+
+	if NO_DIRECT {
+		gc.FailClosed = true
+	}
+	running := currentConfig()
+	ROUTER_CONFIG.Store(&routerConfig{
+		GoixyConfig: gc,
+
+		key:       key,
+		directKey: directKey,
+
+		whiteRules:   whiteRules,
+		blackRules:   blackRules,
+		directRules:  directRules,
+		keyRules:     keyRules,
+		rewriteRules: rewriteRules,
+		whiteHosts:   whiteHosts,
+		whiteDomains: whiteDomains,
+		whiteRegexes: whiteRegexes,
+		routeScript:  script,
+		routeCache:   newLRU(ROUTE_CACHE_SIZE),
+
+		authUsers:   authUsers,
+		authTrusted: authTrusted,
+
+		allowDestinations: allowDestinations,
+		bypass:            loadBypass(),
+
+		flowAddr: flowAddr,
+		flowConn: flowConn,
+
+		localDialer:    dialer,
+		upstreamDialer: upstreamDialer,
+
+		advertiseAddr: advertise,
+		upstreamPin:   pin,
+	})
+	// the socket is shared while FlowCollector is set, whatever its
+	// address, and is no longer needed once it is removed
+	if running.flowConn != nil && flowConn == nil {
+		running.flowConn.Close()
+	}
+	if atomic.SwapInt32(&CONFIG_LOG_LEVEL, int32(logLevel)) != int32(logLevel) {
+		atomic.StoreInt32(&LOG_LEVEL, int32(logLevel))
 	}
+	clearAuthCache()
+	clearDNSCache()
+	BUFFER_BUDGET.setSize(gc.BufferBudget)
+	return nil
 }
 
-func serverInList(shost string) bool {
-	for _, s := range GC.WhiteList {
-		re := regexp.MustCompile(s)
-		s := re.FindString(shost)
-		if s != "" {
-			return true
+// parseAdvertiseAddr parses AdvertiseAddr, an IP with an optional port.
+// An empty one gives nil.
+func parseAdvertiseAddr(s string) (*net.TCPAddr, error) {
+	if s == "" {
+		return nil, nil
+	}
+	host, port := s, "0"
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host, port = h, p
+	}
+	ip := net.ParseIP(host)
+	nport, err := strconv.Atoi(port)
+	if ip == nil || err != nil || nport < 0 || nport > 65535 {
+		return nil, fmt.Errorf("Invalid AdvertiseAddr: %s", s)
+	}
+	return &net.TCPAddr{IP: ip, Port: nport}, nil
+}
+
+// normalizeHost collapses IPv4-mapped IPv6 forms (::ffff:1.2.3.4) to the
+// dotted quad, so rules written for IPv4 match either way.
+func normalizeHost(shost string) string {
+	ip := net.ParseIP(strings.Trim(shost, "[]"))
+	if ip != nil && ip.To4() != nil {
+		return ip.To4().String()
+	}
+	return shost
+}
+
+// splitRulePort splits an optional port spec off a rule: "example.com:443"
+// gives ("example.com", "443"). "*" or no port means any port.
+func splitRulePort(rule string) (string, string) {
+	m := RE_RULE_PORT.FindStringSubmatch(rule)
+	if m == nil {
+		return rule, ""
+	}
+	if m[2] == "*" {
+		return m[1], ""
+	}
+	return m[1], m[2]
+}
+
+func serverInList(cfg *routerConfig, shost, sport string) bool {
+	inList, _ := whiteListMatch(cfg, shost, sport)
+	return inList
+}
+
+// whiteListMatch is serverInList, with complete false when the regexes
+// were given up after WhiteListBudget milliseconds.
+func whiteListMatch(cfg *routerConfig, shost, sport string) (inList, complete bool) {
+	shost = normalizeHost(shost)
+	if hits, ok := cfg.whiteHosts[shost]; ok {
+		atomic.AddUint64(hits, 1)
+		return true, true
+	}
+	// shost and each parent domain of it
+	for domain := shost; domain != ""; {
+		if hits, ok := cfg.whiteDomains[domain]; ok {
+			atomic.AddUint64(hits, 1)
+			return true, true
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
 		}
+		domain = domain[i+1:]
 	}
-	return false
+	budget := time.Duration(cfg.WhiteListBudget) * time.Millisecond
+	rule, ok, complete := firstRuleWithin(cfg.whiteRegexes, shost, sport, budget)
+	if ok {
+		atomic.AddUint64(rule.Hits, 1)
+	}
+	return ok, complete
+}
+
+func serverInBlackList(cfg *routerConfig, shost, sport string) bool {
+	shost = normalizeHost(shost)
+	return matchRules(cfg.blackRules, shost, sport)
 }
 
 func fmtHumanBytes(n_bytes int64) string {
@@ -625,8 +2425,78 @@ func fmtTimeSpan(n_seconds int64) string {
 type DataInfo struct {
 	data []byte
 	size int
+	hold *bufferHold // of BufferBudget
+}
+
+type Remote struct {
+	Host string
+	Port string
+	Key  []byte
+	Type string
+	User string
+	Pass string
+
+	TLS         bool
+	TLSName     string
+	TLSInsecure bool
+	TLSPin      *CertPin
+
+	// dialed instead of Host, which is then only sent as the Host header
+	// of an httpconnect upstream
+	Front string
+
+	Obfuscate       bool
+	ObfuscateJitter int64
+	Ack             bool
+
+	SendClientIP bool
+
+	UseProxy bool
+
+	Transport string
+
+	Route   string
+	Metered bool
+
+	// the destination after Rewrite, and the route override of the
+	// listener, set by getRemoteInfo
+	DestHost string
+	DestPort string
+	Override string
 }
 
+// whitelist entries that look like a bare hostname; a host equal to one
+// of them always matches it as a regex too, so it can skip the regexes
+var RE_PLAIN_HOST = regexp.MustCompile(`^[A-Za-z0-9.-]+$`)
+
+// request line with an absolute-form target: method, then path and query
+var RE_ABSOLUTE_TARGET = regexp.MustCompile(`^([A-Z]+) [hH][tT][tT][pP][sS]?://[^/?# ]+([^ ]*) `)
+
+// how long to wait for the ack of an UpstreamAck server
+var UPSTREAM_ACK_TIMEOUT = 5 * time.Second
+
+// how long a SOCKS client may take to send its request
+var SOCKS_REQUEST_TIMEOUT = 10 * time.Second
+
+// a trailing ":443" or ":*" in a rule is a port spec
+var RE_RULE_PORT = regexp.MustCompile(`^(.*[^:]):([0-9]+|\*)$`)
+
+// log levels; -v, -vv and -vvv set debug, verbose and trace
+const (
+	LOG_ERROR = iota
+	LOG_WARN
+	LOG_INFO
+	LOG_DEBUG
+	LOG_VERBOSE
+	LOG_TRACE
+)
+
+var LOG_LEVEL_NAMES = []string{"error", "warn", "info", "debug", "verbose", "trace"}
+
+const UPSTREAM_LIGHTSOCKS = "lightsocks"
+const UPSTREAM_SOCKS5 = "socks5"
+const UPSTREAM_HTTPCONNECT = "httpconnect"
+
 const ATYP_IPV4 = 1
 const ATYP_DOMAIN = 3
 const ATYP_IPV6 = 4
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mitnk/goutils/encrypt"
+	cmap "github.com/orcaman/concurrent-map"
+	"go.starlark.net/starlark"
+)
+
+var TEST_KEY = sha256.Sum256([]byte("goixy-test"))
+
+// mockUpstream is a lightsocks server that relays to the host and port
+// of the handshake. sent counts the encrypted bytes of the frames it sent
+// back, which goixy counts in Servers. With keepalive set, it also sends
+// a keepalive frame that often. With requests set, it hands over the
+// destination and the first frame instead of relaying.
+type mockUpstream struct {
+	ln        net.Listener
+	key       []byte
+	sent      int64
+	keepalive time.Duration
+	requests  chan mockRequest
+}
+
+type mockRequest struct {
+	host string
+	port string
+	data []byte
+}
+
+func newMockUpstream(t *testing.T) *mockUpstream {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	m := &mockUpstream{ln: ln, key: TEST_KEY[:]}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go m.relay(conn)
+		}
+	}()
+	return m
+}
+
+func (m *mockUpstream) relay(conn net.Conn) {
+	defer conn.Close()
+	// check bytes, host, then port
+	fields := [][]byte{}
+	for i := 0; i < 2; i++ {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		field := make([]byte, b[0])
+		if _, err := io.ReadFull(conn, field); err != nil {
+			return
+		}
+		fields = append(fields, field)
+	}
+	host, err := encrypt.Decrypt(fields[1], m.key)
+	if err != nil {
+		return
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(b)))
+	if m.requests != nil {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		frame := make([]byte, binary.BigEndian.Uint16(b))
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			return
+		}
+		data, _ := encrypt.Decrypt(frame, m.key)
+		m.requests <- mockRequest{string(host), port, data}
+		return
+	}
+	origin, err := net.Dial("tcp", net.JoinHostPort(string(host), port))
+	if err != nil {
+		return
+	}
+	defer origin.Close()
+
+	var mu sync.Mutex
+	write := func(b []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		_, err := conn.Write(b)
+		return err
+	}
+	if m.keepalive > 0 {
+		go func() {
+			for {
+				time.Sleep(m.keepalive)
+				if write([]byte{0, 0}) != nil {
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		defer origin.Close()
+		for {
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				return
+			}
+			size := binary.BigEndian.Uint16(b)
+			if size == 0 {
+				continue
+			}
+			frame := make([]byte, size)
+			if _, err := io.ReadFull(conn, frame); err != nil {
+				return
+			}
+			data, err := encrypt.Decrypt(frame, m.key)
+			if err != nil {
+				return
+			}
+			if _, err := origin.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+	data := make([]byte, 8192)
+	for {
+		n, err := origin.Read(data)
+		if n > 0 {
+			frame := encrypt.Encrypt(data[:n], m.key)
+			atomic.AddInt64(&m.sent, int64(len(frame)))
+			b := make([]byte, 2)
+			binary.BigEndian.PutUint16(b, uint16(len(frame)))
+			if err := write(append(b, frame...)); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// useConfig runs goixy with cfg, on top of EMPTY_CONFIG, until the test
+// ends.
+func useConfig(t *testing.T, cfg routerConfig) {
+	old := currentConfig()
+	cfg.routeCache = newLRU(ROUTE_CACHE_SIZE)
+	ROUTER_CONFIG.Store(&cfg)
+	t.Cleanup(func() { ROUTER_CONFIG.Store(old) })
+}
+
+// upstreamConfig is a config that routes everything to m.
+func upstreamConfig(m *mockUpstream) routerConfig {
+	cfg := *EMPTY_CONFIG
+	cfg.Host, cfg.Port, _ = net.SplitHostPort(m.ln.Addr().String())
+	cfg.key = m.key
+	return cfg
+}
+
+// startGoixy serves clients on a loopback listener, as main does, and
+// returns its address.
+func startGoixy(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		// the next test may change the globals its connections read
+		CLIENTS_WG.Wait()
+	})
+	go acceptClients(ln, "")
+	return ln.Addr().String()
+}
+
+// startRelay relays a loopback connection to shost:sport through m with
+// handleRemote, and returns the client end.
+func startRelay(t *testing.T, cfg *routerConfig, m *mockUpstream, shost, sport string) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	host, port, _ := net.SplitHostPort(m.ln.Addr().String())
+	r := Remote{Host: host, Port: port, Key: m.key, Route: ROUTE_UPSTREAM}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		client, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		handleRemote(cfg, newConnLog(), client, shost, sport, r, nil, nil, false, false, false)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	return conn
+}
+
+// startEcho starts a server that sends back what it gets, and returns its
+// host and port.
+func startEcho(t *testing.T) (string, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	return host, port
+}
+
+// serverBytes returns the bytes counted in Servers for key, -1 when it
+// has no entry.
+func serverBytes(key string) int64 {
+	m, ok := SERVER_INFO.Get(key)
+	if !ok {
+		return -1
+	}
+	n, ok := m.(cmap.ConcurrentMap).Get("bytes")
+	if !ok {
+		return -1
+	}
+	return n.(int64)
+}
+
+func TestHandleClient(t *testing.T) {
+	body := bytes.Repeat([]byte("goixy "), 20000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(body)
+	}))
+	defer origin.Close()
+	originAddr := origin.Listener.Addr().String()
+
+	tests := []struct {
+		name string
+		// sent first, and the reply to it, before the request
+		tunnel string
+		reply  string
+		req    string
+	}{
+		{
+			name: "http",
+			req:  "GET http://" + originAddr + "/x HTTP/1.1\r\nHost: " + originAddr + "\r\n\r\n",
+		},
+		{
+			name:   "connect",
+			tunnel: "CONNECT " + originAddr + " HTTP/1.1\r\nHost: " + originAddr + "\r\n\r\n",
+			reply:  "HTTP/1.0 200 OK\r\n\r\n",
+			req:    "GET /x HTTP/1.1\r\nHost: " + originAddr + "\r\n\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockUpstream(t)
+			useConfig(t, upstreamConfig(m))
+			conn, err := net.Dial("tcp", startGoixy(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+
+			if tt.tunnel != "" {
+				conn.Write([]byte(tt.tunnel))
+				reply := make([]byte, len(tt.reply))
+				if _, err := io.ReadFull(br, reply); err != nil {
+					t.Fatal(err)
+				}
+				if string(reply) != tt.reply {
+					t.Fatalf("reply to %q: got %q, want %q", tt.tunnel, reply, tt.reply)
+				}
+			}
+			conn.Write([]byte(tt.req))
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != 200 || !bytes.Equal(got, body) {
+				t.Fatalf("got status %d and %d bytes, want 200 and %d bytes", resp.StatusCode, len(got), len(body))
+			}
+
+			// the connection is still open, so is its Servers entry
+			if n, want := serverBytes(originAddr), atomic.LoadInt64(&m.sent); n != want {
+				t.Errorf("Servers bytes for %s: got %d, want %d", originAddr, n, want)
+			}
+		})
+	}
+}
+
+// The destination of an IPv6 literal is unbracketed, like a SOCKS one,
+// while the Host header added for a request without one keeps the [].
+func TestHandleHTTPIPv6(t *testing.T) {
+	tests := []struct {
+		url  string
+		port string
+		host string
+	}{
+		{"http://[2606:4700::]/", "80", "[2606:4700::]"},
+		{"http://[2606:4700::]:8080/", "8080", "[2606:4700::]:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			m := newMockUpstream(t)
+			m.requests = make(chan mockRequest, 1)
+			useConfig(t, upstreamConfig(m))
+			conn, err := net.Dial("tcp", startGoixy(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("GET " + tt.url + " HTTP/1.1\r\nAccept: */*\r\n\r\n"))
+
+			var req mockRequest
+			select {
+			case req = <-m.requests:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no request reached the upstream")
+			}
+			if req.host != "2606:4700::" || req.port != tt.port {
+				t.Errorf("destination %s %s, want 2606:4700:: %s", req.host, req.port, tt.port)
+			}
+			want := "GET / HTTP/1.1\r\nHost: " + tt.host + "\r\nAccept: */*\r\n\r\n"
+			if string(req.data) != want {
+				t.Errorf("request %q, want %q", req.data, want)
+			}
+		})
+	}
+}
+
+// A stream that keeps sending for longer than SPAN_TIMEOUT stays open, as
+// only data that stops for SPAN_TIMEOUT times it out. Keepalives, ours or
+// the upstream's, do not count.
+func TestHandleRemoteIdle(t *testing.T) {
+	old := SPAN_TIMEOUT
+	SPAN_TIMEOUT = 1
+	defer func() { SPAN_TIMEOUT = old }()
+	span := time.Second * time.Duration(SPAN_TIMEOUT)
+	shost, sport := startEcho(t)
+
+	t.Run("slow stream", func(t *testing.T) {
+		conn := startRelay(t, EMPTY_CONFIG, newMockUpstream(t), shost, sport)
+		b := make([]byte, 1)
+		for started := time.Now(); time.Since(started) < 2*span+span/2; {
+			if _, err := conn.Write([]byte{'x'}); err != nil {
+				t.Fatalf("write after %v: %v", time.Since(started), err)
+			}
+			conn.SetReadDeadline(time.Now().Add(span))
+			if _, err := io.ReadFull(conn, b); err != nil {
+				t.Fatalf("closed after %v of a slow stream: %v", time.Since(started), err)
+			}
+			time.Sleep(span / 4)
+		}
+	})
+
+	t.Run("keepalives only", func(t *testing.T) {
+		cfg := *EMPTY_CONFIG
+		cfg.KeepAlive = 1
+		m := newMockUpstream(t)
+		m.keepalive = span / 5
+		conn := startRelay(t, &cfg, m, shost, sport)
+		started := time.Now()
+		conn.SetReadDeadline(time.Now().Add(3 * span))
+		_, err := conn.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("still open after %v of keepalives alone", 3*span)
+		}
+		if idle := time.Since(started); idle < span-span/10 {
+			t.Errorf("closed after %v, before SPAN_TIMEOUT %v", idle, span)
+		}
+	})
+}
+
+func TestRewriteRequestLine(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"GET http://example.com/a HTTP/1.1\r\n", "GET /a HTTP/1.1\r\n"},
+		{"HEAD http://example.com/a HTTP/1.1\r\n", "HEAD /a HTTP/1.1\r\n"},
+		{"POST http://example.com/a HTTP/1.1\r\nContent-Length: 1\r\n\r\nx", "POST /a HTTP/1.1\r\nContent-Length: 1\r\n\r\nx"},
+		{"GET http://example.com HTTP/1.1\r\n", "GET / HTTP/1.1\r\n"},
+		{"GET HTTPS://example.com/a HTTP/1.1\r\n", "GET /a HTTP/1.1\r\n"},
+		// query string
+		{"GET http://example.com/a?b=1&c=2 HTTP/1.1\r\n", "GET /a?b=1&c=2 HTTP/1.1\r\n"},
+		{"GET http://example.com?b=1 HTTP/1.1\r\n", "GET /?b=1 HTTP/1.1\r\n"},
+		// explicit port
+		{"GET http://example.com:8080/a HTTP/1.1\r\n", "GET /a HTTP/1.1\r\n"},
+		{"GET http://[2606:4700::]:8080/a HTTP/1.1\r\n", "GET /a HTTP/1.1\r\n"},
+		// asterisk-form
+		{"OPTIONS http://example.com HTTP/1.1\r\n", "OPTIONS * HTTP/1.1\r\n"},
+		{"OPTIONS http://example.com/ HTTP/1.1\r\n", "OPTIONS / HTTP/1.1\r\n"},
+		{"OPTIONS * HTTP/1.1\r\n", "OPTIONS * HTTP/1.1\r\n"},
+		// authority-form and origin-form are left as is
+		{"CONNECT example.com:443 HTTP/1.1\r\n", "CONNECT example.com:443 HTTP/1.1\r\n"},
+		{"GET /a HTTP/1.1\r\n", "GET /a HTTP/1.1\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(rewriteRequestLine([]byte(tt.in))); got != tt.want {
+			t.Errorf("rewriteRequestLine(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// socksConn feeds a request to readSocksRequest and keeps its replies.
+type socksConn struct {
+	io.Reader
+	io.Writer
+}
+
+func FuzzParseSocks(f *testing.F) {
+	ipv4 := []byte{5, 1, 0, ATYP_IPV4, 127, 0, 0, 1, 0, 80}
+	domain := append([]byte{5, 1, 0, ATYP_DOMAIN, 11}, "example.com\x01\xbb"...)
+	login := append([]byte{1, 2, 1, 5}, "alice\x06secret"...)
+	seeds := [][]byte{
+		append([]byte{1, 0}, ipv4...),
+		append([]byte{1, 0}, domain...),
+		append(login, ipv4...),
+		// truncated methods
+		{},
+		{0},
+		{3, 0},
+		{2, 0, 2},
+		// zero-length domain
+		{1, 0, 5, 1, 0, ATYP_DOMAIN, 0, 0, 80},
+		// bad atyp, and IPv6
+		{1, 0, 5, 1, 0, 2, 127, 0, 0, 1, 0, 80},
+		{1, 0, 5, 1, 0, ATYP_IPV6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80},
+		// bind and udp associate
+		{1, 0, 5, 2, 0, ATYP_IPV4, 127, 0, 0, 1, 0, 80},
+		{1, 0, 5, 3, 0, ATYP_IPV4, 127, 0, 0, 1, 0, 80},
+		// bad credentials and a truncated login
+		{1, 2, 1, 5, 'a', 'l', 'i', 'c', 'e', 1, 'x'},
+		{1, 2, 1, 5, 'a', 'l'},
+	}
+	for _, seed := range seeds {
+		f.Add(seed, false)
+		f.Add(seed, true)
+	}
+
+	cfg := *EMPTY_CONFIG
+	cfg.authUsers = map[string]string{"alice": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="}
+	f.Fuzz(func(t *testing.T, data []byte, auth bool) {
+		replies := &bytes.Buffer{}
+		shost, sport, err := readSocksRequest(&cfg, socksConn{bytes.NewReader(data), replies}, auth)
+		if err != nil {
+			if _, ok := err.(*SocksError); !ok {
+				t.Fatalf("error %v is not a SocksError", err)
+			}
+			return
+		}
+		if shost == "" {
+			t.Fatalf("no host from %x", data)
+		}
+		if port, err := strconv.Atoi(sport); err != nil || port < 0 || port > 0xffff {
+			t.Fatalf("bad port %q from %x", sport, data)
+		}
+		// username/password chosen and accepted
+		loggedIn := bytes.HasPrefix(replies.Bytes(), []byte{5, 2, 1, 0})
+		if auth && !loggedIn {
+			t.Fatalf("connected without login from %x", data)
+		}
+		if !loggedIn && !bytes.HasPrefix(replies.Bytes(), []byte{5, 0}) {
+			t.Fatalf("connected with replies %x from %x", replies.Bytes(), data)
+		}
+	})
+}
+
+func TestWriteFrame(t *testing.T) {
+	tests := []struct {
+		size      int
+		obfuscate bool
+	}{
+		{MAX_FRAME_DATA - 1, false},
+		{MAX_FRAME_DATA, false},
+		{MAX_FRAME_DATA + 1, false},
+		{70000, false},
+		{MAX_FRAME_DATA - 1, true},
+		{MAX_FRAME_DATA, true},
+		{MAX_FRAME_DATA + 1, true},
+		{70000, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d obfuscate=%v", tt.size, tt.obfuscate), func(t *testing.T) {
+			r := Remote{Key: TEST_KEY[:], Obfuscate: tt.obfuscate}
+			data := make([]byte, tt.size)
+			for i := range data {
+				data[i] = byte(i)
+			}
+			local, remote := net.Pipe()
+			defer remote.Close()
+			done := make(chan error, 1)
+			go func() {
+				done <- writeFrame(local, data, r)
+				local.Close()
+			}()
+
+			// a net.Pipe read gets at most one write: the length prefix,
+			// then the whole encrypted frame
+			got := []byte{}
+			frames := 0
+			buffer := make([]byte, 0x20000)
+			b := make([]byte, 2)
+			for {
+				if _, err := io.ReadFull(remote, b); err != nil {
+					break
+				}
+				length := int(binary.BigEndian.Uint16(b))
+				n, err := remote.Read(buffer)
+				if err != nil {
+					t.Fatalf("frame %d: %v", frames, err)
+				}
+				if n != length || n > 0xffff {
+					t.Fatalf("frame %d of %d bytes has length %d", frames, n, length)
+				}
+				plain, err := encrypt.Decrypt(buffer[:n], r.Key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.obfuscate {
+					plain, err = unpadFrame(plain)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				got = append(got, plain...)
+				frames += 1
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("got %d bytes back in %d frames, not the data", len(got), frames)
+			}
+			if want := (tt.size + MAX_FRAME_DATA - 1) / MAX_FRAME_DATA; frames != want {
+				t.Errorf("%d frames, want %d", frames, want)
+			}
+		})
+	}
+}
+
+// A connection that took the config before a reload routes with it to
+// the end, while what it caches is not seen by the connections after.
+func TestRouteCacheReload(t *testing.T) {
+	useConfig(t, *EMPTY_CONFIG)
+	cfg := currentConfig()
+
+	reloaded := *EMPTY_CONFIG
+	reloaded.FailClosed = true
+	reloaded.whiteHosts = map[string]*uint64{"example.com": new(uint64)}
+	useConfig(t, reloaded)
+
+	// the lookup of the connection ends after the reload
+	if r, ok := routeRemote(cfg, newConnLog(), "example.com", "443", "127.0.0.1", true, ""); !ok || r.Route != ROUTE_UPSTREAM {
+		t.Fatalf("before the reload: got %q, %v, want upstream", r.Route, ok)
+	}
+	if r, ok := routeRemote(currentConfig(), newConnLog(), "example.com", "443", "127.0.0.1", true, ""); !ok || r.Route != ROUTE_UPSTREAM {
+		t.Errorf("after the reload: got %q, %v, want upstream", r.Route, ok)
+	}
+}
+
+// "direct" from RouteScript goes to DirectHost, and is refused without
+// one rather than dialing this host.
+func TestRouteScriptDirect(t *testing.T) {
+	direct := starlark.NewBuiltin("route", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return starlark.String(ROUTE_DIRECT), nil
+	})
+	tests := []struct {
+		directHost string
+		ok         bool
+	}{
+		{"", false},
+		{"192.0.2.1", true},
+	}
+	for _, tt := range tests {
+		cfg := *EMPTY_CONFIG
+		cfg.routeScript = direct
+		cfg.DirectHost, cfg.DirectPort = tt.directHost, "1080"
+		r, ok := routeRemote(&cfg, newConnLog(), "example.com", "443", "127.0.0.1", false, "")
+		if ok != tt.ok {
+			t.Errorf("DirectHost %q: ok %v, want %v", tt.directHost, ok, tt.ok)
+		}
+		if ok && (r.Route != ROUTE_DIRECT || r.Host != tt.directHost) {
+			t.Errorf("DirectHost %q: routed %s to %s", tt.directHost, r.Route, r.Host)
+		}
+	}
+}
+
+// A buffer that is never relayed, as its peer stopped reading, gives its
+// share of BufferBudget back after BUFFER_HOLD.
+func TestBufferBudgetHold(t *testing.T) {
+	hold := BUFFER_HOLD
+	BUFFER_HOLD = 50 * time.Millisecond
+	defer func() { BUFFER_HOLD = hold }()
+	b := newBufferBudget()
+	b.setSize(100)
+
+	stalled := b.acquire(100)
+	start := time.Now()
+	h := b.acquire(60)
+	if waited := time.Since(start); waited < BUFFER_HOLD {
+		t.Errorf("acquire waited %v, want at least %v", waited, BUFFER_HOLD)
+	}
+	// relaying the stalled buffer at last gives nothing back twice
+	b.release(stalled)
+	b.release(h)
+	b.release(h)
+	if b.used != 0 {
+		t.Errorf("used = %d after all were released, want 0", b.used)
+	}
+	h = b.acquire(100)
+	if h == nil {
+		t.Error("no hold with BufferBudget set")
+	}
+	b.release(h)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+
+	"github.com/xtaci/kcp-go"
+)
+
+const TRANSPORT_TCP = "tcp"
+const TRANSPORT_KCP = "kcp"
+
+// KCPConfig tunes the KCP session to Host:Port. Zero values keep the
+// kcp-go defaults, except Interval which defaults to 40ms.
+type KCPConfig struct {
+	NoDelay      bool
+	Interval     int
+	Resend       int
+	NoCongestion bool
+	SndWnd       int
+	RcvWnd       int
+}
+
+// dialKCP opens a KCP session to addr. It runs in stream mode, so the
+// goixy frames go over it exactly as over TCP.
+func dialKCP(cfg *routerConfig, addr string) (net.Conn, error) {
+	sess, err := kcp.DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	c := cfg.KCP
+	interval := c.Interval
+	if interval == 0 {
+		interval = 40
+	}
+	nodelay, nc := 0, 0
+	if c.NoDelay {
+		nodelay = 1
+	}
+	if c.NoCongestion {
+		nc = 1
+	}
+	sess.SetStreamMode(true)
+	sess.SetNoDelay(nodelay, interval, c.Resend, nc)
+	if c.SndWnd > 0 || c.RcvWnd > 0 {
+		sess.SetWindowSize(c.SndWnd, c.RcvWnd)
+	}
+	return sess, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// ListenAddr is a Listen entry: another host:port to accept clients on.
+// When Route is set ("upstream" or "direct"), its connections all take
+// that route instead of the rule lists.
+type ListenAddr struct {
+	Addr  string
+	Route string
+}
+
+type listener struct {
+	ln    net.Listener
+	route string
+}
+
+// all the addresses goixy listens on, for loop detection
+var LISTEN_ADDRS = []*net.TCPAddr{}
+
+func checkListen(gc GoixyConfig) error {
+	for _, e := range gc.Listen {
+		if _, _, err := net.SplitHostPort(e.Addr); err != nil {
+			return fmt.Errorf("Invalid Listen entry %q: %v", e.Addr, err)
+		}
+		switch e.Route {
+		case "", ROUTE_UPSTREAM:
+		case ROUTE_DIRECT:
+			if gc.DirectHost == "" {
+				return fmt.Errorf("Invalid Listen entry %q: route direct needs DirectHost", e.Addr)
+			}
+			if gc.FailClosed || NO_DIRECT {
+				return fmt.Errorf("Invalid Listen entry %q: route direct with FailClosed", e.Addr)
+			}
+		default:
+			return fmt.Errorf("Invalid Listen entry %q: bad Route %s", e.Addr, e.Route)
+		}
+	}
+	return nil
+}
+
+// openListeners listens on the Listen entries. They are only read at
+// startup, a reload does not change them.
+func openListeners(entries []ListenAddr) ([]listener, error) {
+	listeners := []listener{}
+	for _, e := range entries {
+		ln, err := net.Listen("tcp", e.Addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.ln.Close()
+			}
+			return nil, errors.New(listenError(e.Addr, err))
+		}
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			LISTEN_ADDRS = append(LISTEN_ADDRS, addr)
+		}
+		listeners = append(listeners, listener{ln, e.Route})
+	}
+	return listeners, nil
+}
+
+// acceptClients serves the clients of ln, with route as their route
+// override, until ln is closed by handleSignals.
+func acceptClients(ln net.Listener, route string) {
+	var delay time.Duration
+	for {
+		client, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || isShuttingDown() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > time.Second {
+					delay = time.Second
+				}
+				warn("accept error: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			logError("accept error: %v", err)
+			os.Exit(2)
+		}
+		delay = 0
+		// the other listeners may still accept after main started waiting
+		// for the clients, which then must not be added
+		MUTEX.Lock()
+		if SHUTTING_DOWN {
+			MUTEX.Unlock()
+			client.Close()
+			return
+		}
+		CLIENTS_WG.Add(1)
+		MUTEX.Unlock()
+		go handleClient(client, route)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the address goixy listens on, set in main
+var LISTEN_ADDR *net.TCPAddr
+
+var LOCAL_IPS []net.IP
+var LOCAL_IPS_ONCE sync.Once
+
+// isLocalHost tells if host (a name or IP literal) is this machine: a
+// loopback name or address, or the address of a local interface.
+func isLocalHost(host string) bool {
+	host = strings.Trim(host, "[]")
+	if strings.ToLower(host) == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	LOCAL_IPS_ONCE.Do(func() {
+		addrs, _ := net.InterfaceAddrs()
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok {
+				LOCAL_IPS = append(LOCAL_IPS, n.IP)
+			}
+		}
+	})
+	for _, local := range LOCAL_IPS {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isListenAddr tells if host:port reaches one of goixy's own listeners.
+func isListenAddr(host, port string) bool {
+	for _, addr := range LISTEN_ADDRS {
+		if listensOn(addr, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func listensOn(addr *net.TCPAddr, host, port string) bool {
+	if addr == nil || port != strconv.Itoa(addr.Port) {
+		return false
+	}
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		return isLocalHost(host)
+	}
+	host = strings.Trim(host, "[]")
+	if strings.ToLower(host) == "localhost" {
+		return addr.IP.IsLoopback()
+	}
+	return addr.IP.Equal(net.ParseIP(host))
+}
+
+// routingLoop tells if relaying shost:sport through r would come back to
+// goixy: r is goixy itself, or r runs on this machine and shost:sport is
+// goixy, so r would connect back to it.
+func routingLoop(shost, sport string, r Remote) bool {
+	if r.DestHost != "" {
+		shost, sport = r.DestHost, r.DestPort
+	}
+	if isListenAddr(r.Host, r.Port) {
+		return true
+	}
+	return isLocalHost(r.Host) && isListenAddr(shost, sport)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+// counters published on /debug/vars of the -pprof listener
+var METRIC_BYTES_UP = expvar.NewInt("bytes_up")
+var METRIC_BYTES_DOWN = expvar.NewInt("bytes_down")
+var METRIC_DIAL_FAILURES = expvar.NewInt("dial_failures")
+var METRIC_DECRYPT_ERRORS = expvar.NewInt("decrypt_errors")
+var METRIC_TRUNCATED_FRAMES = expvar.NewInt("truncated_frames")
+var METRIC_BYTES_METERED = expvar.NewInt("bytes_metered")
+var METRIC_BYTES_UNMETERED = expvar.NewInt("bytes_unmetered")
+
+// countMetered adds n bytes relayed through r, in either direction, to
+// the metered or unmetered total.
+func countMetered(r Remote, n int) {
+	if r.Metered {
+		METRIC_BYTES_METERED.Add(int64(n))
+	} else {
+		METRIC_BYTES_UNMETERED.Add(int64(n))
+	}
+}
+
+func init() {
+	expvar.Publish("connections", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&COUNT_CONNECTED)
+	}))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// adaptiveNoDelay turns Nagle back on for a connection once it moves more
+// than NoDelayThreshold bytes within a second, i.e. looks like a bulk
+// transfer. Interactive connections keep TCP_NODELAY, Go's default.
+type adaptiveNoDelay struct {
+	conns     []net.Conn
+	threshold int64
+	window    time.Time
+	bytes     int64
+	batched   bool
+}
+
+func newAdaptiveNoDelay(threshold int64, conns ...net.Conn) *adaptiveNoDelay {
+	return &adaptiveNoDelay{conns: conns, threshold: threshold, window: time.Now()}
+}
+
+// add counts n bytes and reports true when it just switched to batching.
+func (a *adaptiveNoDelay) add(n int) bool {
+	if a.batched || a.threshold <= 0 {
+		return false
+	}
+	if time.Since(a.window) > time.Second {
+		a.window = time.Now()
+		a.bytes = 0
+	}
+	a.bytes += int64(n)
+	if a.bytes <= a.threshold {
+		return false
+	}
+	a.batched = true
+	for _, conn := range a.conns {
+		setNoDelay(conn, false)
+	}
+	return true
+}
+
+func setNoDelay(conn net.Conn, on bool) {
+	if tc := tcpConn(conn); tc != nil {
+		tc.SetNoDelay(on)
+	}
+}
+
+// setSockBufs sets the kernel receive and send buffer sizes of conn, for
+// the sizes that are not 0.
+func setSockBufs(conn net.Conn, rcvbuf, sndbuf int) {
+	tc := tcpConn(conn)
+	if tc == nil {
+		return
+	}
+	if rcvbuf > 0 {
+		tc.SetReadBuffer(rcvbuf)
+	}
+	if sndbuf > 0 {
+		tc.SetWriteBuffer(sndbuf)
+	}
+}
+
+// tcpConn returns the TCP connection under conn, nil for other transports
+// like KCP.
+func tcpConn(conn net.Conn) *net.TCPConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	tc, _ := conn.(*net.TCPConn)
+	return tc
+}
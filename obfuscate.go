@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// With Obfuscate on, the plaintext of every data frame (both directions)
+// is
+//
+//	[2 bytes: payload length][payload][0..OBFS_MAX_PAD random bytes]
+//
+// before encryption. The server has to use the same scheme.
+const OBFS_MAX_PAD = 255
+
+// padFrame wraps data with its length and random padding.
+func padFrame(data []byte) []byte {
+	n := rand.Intn(OBFS_MAX_PAD + 1)
+	b := make([]byte, 2+len(data)+n)
+	binary.BigEndian.PutUint16(b, uint16(len(data)))
+	copy(b[2:], data)
+	rand.Read(b[2+len(data):])
+	return b
+}
+
+// unpadFrame strips what padFrame added.
+func unpadFrame(b []byte) ([]byte, error) {
+	if len(b) < 2 {
+		return nil, errors.New("obfuscated frame too short")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, errors.New("bad obfuscated frame length")
+	}
+	return b[2 : 2+n], nil
+}
+
+// frameJitter sleeps a random time up to ms milliseconds.
+func frameJitter(ms int64) {
+	if ms > 0 {
+		time.Sleep(time.Duration(rand.Int63n(ms+1)) * time.Millisecond)
+	}
+}
+
+// handshakeJitter sleeps a random time up to HandshakeJitter
+// milliseconds, before the SOCKS replies.
+func handshakeJitter(cfg *routerConfig) {
+	if cfg.HandshakeJitter > 0 {
+		time.Sleep(time.Duration(rand.Int63n(cfg.HandshakeJitter+1)) * time.Millisecond)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// pacRules writes rules as a JS array of [RegExp, port] pairs. The rules
+// that jsPattern cannot translate are left out, and logged.
+func pacRules(b *bytes.Buffer, name string, rules []Rule) {
+	fmt.Fprintf(b, "var %s = [\n", name)
+	for _, rule := range rules {
+		pattern, err := jsPattern(rule.Pattern)
+		if err != nil {
+			warn("proxy.pac: %s entry %q left out: %v", name, rule.Pattern, err)
+			continue
+		}
+		p, _ := json.Marshal(pattern)
+		fmt.Fprintf(b, "    [new RegExp(%s), %q],\n", p, rule.Port)
+	}
+	b.WriteString("];\n")
+}
+
+// jsPattern rewrites a Go pattern in the syntax of JS regular expressions,
+// which lack (?i) and the other flag groups, \A, \z, named groups and the
+// Unicode classes. Case folding is spelled out per letter, and classes as
+// ranges cut to the BMP, which holds every rune of a host name. A rune
+// beyond it would need the u flag, so it is an error.
+func jsPattern(pattern string) (string, error) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", err
+	}
+	b := &strings.Builder{}
+	if err := writeJSRegexp(b, re); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func writeJSRegexp(b *strings.Builder, re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		b.WriteString(`[^\s\S]`)
+	case syntax.OpEmptyMatch:
+		b.WriteString(`(?:)`)
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if re.Flags&syntax.FoldCase != 0 && unicode.SimpleFold(r) != r {
+				b.WriteString("[")
+				for f := r; ; {
+					if err := writeJSRune(b, f); err != nil {
+						return err
+					}
+					if f = unicode.SimpleFold(f); f == r {
+						break
+					}
+				}
+				b.WriteString("]")
+			} else if err := writeJSRune(b, r); err != nil {
+				return err
+			}
+		}
+	case syntax.OpCharClass:
+		b.WriteString("[")
+		if len(re.Rune) == 0 {
+			b.WriteString(`^\s\S`)
+		}
+		for i := 0; i < len(re.Rune) && re.Rune[i] <= 0xffff; i += 2 {
+			lo, hi := re.Rune[i], re.Rune[i+1]
+			if hi > 0xffff {
+				hi = 0xffff
+			}
+			writeJSRune(b, lo)
+			if hi != lo {
+				b.WriteString("-")
+				writeJSRune(b, hi)
+			}
+		}
+		b.WriteString("]")
+	case syntax.OpAnyCharNotNL:
+		b.WriteString(`[^\n]`)
+	case syntax.OpAnyChar:
+		b.WriteString(`[\s\S]`)
+	// hosts have no newline, so the line anchors are the text ones
+	case syntax.OpBeginLine, syntax.OpBeginText:
+		b.WriteString("^")
+	case syntax.OpEndLine, syntax.OpEndText:
+		b.WriteString("$")
+	case syntax.OpWordBoundary:
+		b.WriteString(`\b`)
+	case syntax.OpNoWordBoundary:
+		b.WriteString(`\B`)
+	case syntax.OpCapture:
+		b.WriteString("(")
+		if err := writeJSRegexp(b, re.Sub[0]); err != nil {
+			return err
+		}
+		b.WriteString(")")
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		if err := writeJSGroup(b, re.Sub[0], !isJSAtom(re.Sub[0])); err != nil {
+			return err
+		}
+		switch re.Op {
+		case syntax.OpStar:
+			b.WriteString("*")
+		case syntax.OpPlus:
+			b.WriteString("+")
+		case syntax.OpQuest:
+			b.WriteString("?")
+		default:
+			if re.Max == re.Min {
+				fmt.Fprintf(b, "{%d}", re.Min)
+			} else if re.Max < 0 {
+				fmt.Fprintf(b, "{%d,}", re.Min)
+			} else {
+				fmt.Fprintf(b, "{%d,%d}", re.Min, re.Max)
+			}
+		}
+		if re.Flags&syntax.NonGreedy != 0 {
+			b.WriteString("?")
+		}
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if err := writeJSGroup(b, sub, sub.Op == syntax.OpAlternate); err != nil {
+				return err
+			}
+		}
+	case syntax.OpAlternate:
+		for i, sub := range re.Sub {
+			if i > 0 {
+				b.WriteString("|")
+			}
+			if err := writeJSRegexp(b, sub); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported %v", re.Op)
+	}
+	return nil
+}
+
+// writeJSGroup writes re, in a non-capturing group if group is set.
+func writeJSGroup(b *strings.Builder, re *syntax.Regexp, group bool) error {
+	if group {
+		b.WriteString("(?:")
+	}
+	if err := writeJSRegexp(b, re); err != nil {
+		return err
+	}
+	if group {
+		b.WriteString(")")
+	}
+	return nil
+}
+
+// isJSAtom tells whether re is written as one atom a repeat can apply to.
+func isJSAtom(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return len(re.Rune) == 1
+	case syntax.OpCharClass, syntax.OpAnyChar, syntax.OpAnyCharNotNL, syntax.OpCapture:
+		return true
+	}
+	return false
+}
+
+// writeJSRune writes r escaped for a JS pattern, in or out of a class.
+func writeJSRune(b *strings.Builder, r rune) error {
+	switch {
+	case r > 0xffff:
+		return fmt.Errorf("rune %U needs the u flag", r)
+	case strings.ContainsRune(`\^$.|?*+()[]{}/-`, r):
+		b.WriteString(`\`)
+		b.WriteRune(r)
+	case r < ' ' || r > '~':
+		fmt.Fprintf(b, `\u%04x`, r)
+	default:
+		b.WriteRune(r)
+	}
+	return nil
+}
+
+// generatePAC builds a FindProxyForURL sending the hosts goixy would
+// route upstream (or refuse) to proxy, and the others direct. With
+// FailClosed goixy never goes direct, and so neither does the browser.
+func generatePAC(cfg *routerConfig, proxy string) []byte {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "// generated by goixy v%s from %s\n", VERSION, configPath())
+	pacRules(b, "blackList", cfg.blackRules)
+	pacRules(b, "directList", cfg.directRules)
+	pacRules(b, "whiteList", append(append([]Rule{}, cfg.whiteRules...), cfg.keyRules...))
+	fmt.Fprintf(b, "var proxy = %q;\n", proxy)
+	direct := "DIRECT"
+	if cfg.FailClosed {
+		direct = proxy
+	}
+	fmt.Fprintf(b, "var direct = %q;\n", direct)
+	b.WriteString(`
+function matchList(list, host, port) {
+    for (var i = 0; i < list.length; i++) {
+        if (list[i][1] != "" && list[i][1] != port) {
+            continue;
+        }
+        if (list[i][0].test(host)) {
+            return true;
+        }
+    }
+    return false;
+}
+
+function FindProxyForURL(url, host) {
+    var m = url.match(/^[a-z]+:\/\/(?:[^\/@]*@)?(?:\[[^\]]*\]|[^\/:]*):(\d+)/i);
+    var port = m ? m[1] : (url.substring(0, 6) == "https:" ? "443" : "80");
+    // refused by goixy, so let it answer
+    if (matchList(blackList, host, port)) {
+        return proxy;
+    }
+    if (matchList(directList, host, port)) {
+        return direct;
+    }
+    if (matchList(whiteList, host, port)) {
+        return proxy;
+    }
+    return direct;
+}
+`)
+	return b.Bytes()
+}
+
+// handlePAC serves the PAC file. When goixy listens on all interfaces,
+// the host the client fetched it from is taken as goixy's address.
+func handlePAC(w http.ResponseWriter, req *http.Request) {
+	if LISTEN_ADDR == nil {
+		http.Error(w, "not listening", http.StatusServiceUnavailable)
+		return
+	}
+	host := LISTEN_ADDR.IP.String()
+	if LISTEN_ADDR.IP.IsUnspecified() {
+		host = req.Host
+		if h, _, err := net.SplitHostPort(req.Host); err == nil {
+			host = h
+		}
+	}
+	proxy := "SOCKS5 " + net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(LISTEN_ADDR.Port))
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Write(generatePAC(currentConfig(), proxy))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJSPattern(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`(^|\.)example\.com$`, `(^|\.)example\.com$`},
+		{`(?i)^Ab\.com$`, `^[Aa][Bb]\.[Cc][Oo][Mm]$`},
+		{`^a(?i:b)c$`, `^a[Bb]c$`},
+		{`\Aexample\.com\z`, `^example\.com$`},
+		{`^(?P<sub>[a-z]+)\.example\.com$`, `^([a-z]+)\.example\.com$`},
+		{`^[^.]+\.example\.com$`, `^[\u0000-\-\/-\uffff]+\.example\.com$`},
+		{`(?s)^a.b$`, `^a[\s\S]b$`},
+		{`^a.b$`, `^a[^\n]b$`},
+		{`^(?:ab){2,}c{1,3}?d{2}$`, `^(?:ab){2,}c{1,3}?d{2}$`},
+		{`^\d+\.\d+\.\d+\.\d+$`, `^[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+$`},
+		{`^(a|bc)d$`, `^(a|bc)d$`},
+		{`a/b`, `a\/b`},
+	}
+	for _, tt := range tests {
+		got, err := jsPattern(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("jsPattern(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+	if got, err := jsPattern("^\U0001F600\\.example$"); err == nil {
+		t.Errorf("jsPattern of a rune beyond the BMP = %q, want an error", got)
+	}
+}
+
+func TestGeneratePAC(t *testing.T) {
+	white, err := compileRules("WhiteList", []string{`(?i)\.example\.com\z`, "^\U0001F600\\.example$"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		failClosed bool
+		direct     string
+	}{
+		{false, `var direct = "DIRECT";`},
+		{true, `var direct = "SOCKS5 127.0.0.1:1080";`},
+	}
+	for _, tt := range tests {
+		cfg := *EMPTY_CONFIG
+		cfg.whiteRules = white
+		cfg.FailClosed = tt.failClosed
+		pac := string(generatePAC(&cfg, "SOCKS5 127.0.0.1:1080"))
+		if !strings.Contains(pac, tt.direct) {
+			t.Errorf("FailClosed %v: no %s in\n%s", tt.failClosed, tt.direct, pac)
+		}
+		if !strings.Contains(pac, `[new RegExp("\\.[Ee][Xx][Aa][Mm][Pp][Ll][Ee]\\.[Cc][Oo][Mm]$"), ""],`) {
+			t.Errorf("no translated WhiteList entry in\n%s", pac)
+		}
+		if strings.Count(pac, "new RegExp") != 1 {
+			t.Errorf("the entry beyond the BMP is not left out of\n%s", pac)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// CertPin is a parsed UpstreamPin: the SHA-256 of a certificate's
+// SubjectPublicKeyInfo, or a whole certificate.
+type CertPin struct {
+	SPKI []byte
+	Cert []byte
+}
+
+// parseCertPin parses UpstreamPin: "sha256//<base64>" for a public key
+// hash (as curl --pinnedpubkey takes it), or a PEM certificate, inline or
+// as a file path. An empty one gives nil.
+func parseCertPin(s string) (*CertPin, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(s, "sha256//") {
+		sum, err := base64.StdEncoding.DecodeString(s[len("sha256//"):])
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("Invalid UpstreamPin: bad sha256 hash")
+		}
+		return &CertPin{SPKI: sum}, nil
+	}
+	data := []byte(s)
+	if !strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN") {
+		var err error
+		data, err = ioutil.ReadFile(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid UpstreamPin: %v", err)
+		}
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("Invalid UpstreamPin: no PEM certificate")
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, fmt.Errorf("Invalid UpstreamPin: %v", err)
+	}
+	return &CertPin{Cert: block.Bytes}, nil
+}
+
+// verify is used as tls.Config.VerifyPeerCertificate, checking the leaf
+// certificate of the upstream against the pin instead of the CA store.
+func (p *CertPin) verify(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("upstream sent no certificate")
+	}
+	if p.Cert != nil {
+		if !bytes.Equal(rawCerts[0], p.Cert) {
+			return errors.New("upstream certificate does not match UpstreamPin")
+		}
+		return nil
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	if !bytes.Equal(sum[:], p.SPKI) {
+		return fmt.Errorf("upstream public key sha256//%s does not match UpstreamPin",
+			base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"strings"
+)
+
+// startPprof serves net/http/pprof, the expvar counters on /debug/vars,
+// the /healthz and /readyz checks and /proxy.pac on addr. A bare port
+// (":6060" or "6060") is bound to localhost so profiles are not exposed
+// by accident.
+func startPprof(addr string) {
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		info("pprof listen: %v", err)
+		return
+	}
+	info("pprof on http://%s/debug/pprof/, counters on /debug/vars", ln.Addr())
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	http.HandleFunc("/proxy.pac", handlePAC)
+	go func() {
+		err := http.Serve(ln, nil)
+		if err != nil {
+			info("pprof serve: %v", err)
+		}
+	}()
+}
+
+// handleHealthz answers 200 while goixy accepts connections, and 503 once
+// it is draining for shutdown. The listener only starts after the config
+// is loaded, and upstreams are not probed.
+func handleHealthz(w http.ResponseWriter, req *http.Request) {
+	if isShuttingDown() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to username, and to groupname or
+// else the primary group of username, e.g. once a privileged port is
+// bound as root.
+func dropPrivileges(username, groupname string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+	gid := u.Gid
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			return err
+		}
+		gid = g.Gid
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("bad uid %s: %v", u.Uid, err)
+	}
+	ngid, err := strconv.Atoi(gid)
+	if err != nil {
+		return fmt.Errorf("bad gid %s: %v", gid, err)
+	}
+	// the group first, as only root may change it
+	if err := syscall.Setgroups([]int{ngid}); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(ngid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func dropPrivileges(username, groupname string) error {
+	return errors.New("dropping privileges needs Linux")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ptrEntry struct {
+	names   []string
+	expires time.Time
+}
+
+var PTR_CACHE = map[string]ptrEntry{}
+var PTR_MUTEX = &sync.Mutex{}
+var PTR_TTL = 10 * time.Minute
+var PTR_TIMEOUT = 2 * time.Second
+
+// lookupPTR returns the reverse DNS names of ip, cached for PTR_TTL.
+// Failed lookups are cached too, as an empty list.
+func lookupPTR(ip string) []string {
+	PTR_MUTEX.Lock()
+	e, ok := PTR_CACHE[ip]
+	PTR_MUTEX.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.names
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PTR_TIMEOUT)
+	defer cancel()
+	names, err := SYSTEM_RESOLVER.LookupAddr(ctx, ip)
+	if err != nil {
+		debug("reverse lookup of %s: %v", ip, err)
+	}
+	for i, name := range names {
+		names[i] = strings.TrimSuffix(name, ".")
+	}
+	PTR_MUTEX.Lock()
+	PTR_CACHE[ip] = ptrEntry{names, time.Now().Add(PTR_TTL)}
+	PTR_MUTEX.Unlock()
+	return names
+}
+
+// ptrInList reports whether any reverse DNS name of shost is in
+// WhiteList. shost is an IP literal, or with ResolveLocally a name, which
+// is then connected to by its IP and so routed by the names of that IP.
+func ptrInList(cfg *routerConfig, lg connLog, shost, sport string) bool {
+	ip := strings.Trim(shost, "[]")
+	if net.ParseIP(ip) == nil {
+		if !cfg.ResolveLocally {
+			return false
+		}
+		var err error
+		// handleRemote reports the failure when it resolves it again
+		ip, err = resolveHost(cfg, lg, shost)
+		if err != nil {
+			return false
+		}
+	}
+	for _, name := range lookupPTR(ip) {
+		if serverInList(cfg, name, sport) {
+			lg.debug("%s matches WhiteList by its PTR name %s", shost, name)
+			return true
+		}
+	}
+	return false
+}
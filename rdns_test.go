@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// fakeResolver answers from its maps, and fails for anything else.
+type fakeResolver struct {
+	ips   map[string]string
+	names map[string]string
+}
+
+func (r fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip, ok := r.ips[host]; ok {
+		return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if name, ok := r.names[addr]; ok {
+		return []string{name}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+// With ResolveLocally a name is routed by the PTR names of its IP, which
+// goixy connects to, and an IP by its own.
+func TestListRouteReverseDNS(t *testing.T) {
+	resolver, dnsCache, ptrCache := SYSTEM_RESOLVER, DNS_CACHE, PTR_CACHE
+	SYSTEM_RESOLVER = fakeResolver{
+		ips: map[string]string{
+			"shop.example.com": "192.0.2.7",
+			"blog.example.com": "192.0.2.8",
+		},
+		names: map[string]string{
+			"192.0.2.7": "edge7.cdn.example.net.",
+			"192.0.2.8": "host8.example.org.",
+		},
+	}
+	defer func() { SYSTEM_RESOLVER, DNS_CACHE, PTR_CACHE = resolver, dnsCache, ptrCache }()
+
+	white, err := compileRules("WhiteList", []string{`\.cdn\.example\.net$`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		shost          string
+		resolveLocally bool
+		want           string
+	}{
+		{"shop.example.com", true, ROUTE_UPSTREAM},
+		{"blog.example.com", true, ""},
+		{"nowhere.example.com", true, ""},
+		// the remote resolves it, so its IP is not known
+		{"shop.example.com", false, ""},
+		{"192.0.2.7", false, ROUTE_UPSTREAM},
+		{"192.0.2.8", false, ""},
+	}
+	for _, tt := range tests {
+		DNS_CACHE, PTR_CACHE = map[string]dnsEntry{}, map[string]ptrEntry{}
+		cfg := *EMPTY_CONFIG
+		cfg.whiteRegexes = white
+		cfg.ReverseDNS = true
+		cfg.ResolveLocally = tt.resolveLocally
+		if got, _ := listRoute(&cfg, newConnLog(), tt.shost, "443"); got != tt.want {
+			t.Errorf("listRoute of %s with ResolveLocally %v = %q, want %q", tt.shost, tt.resolveLocally, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mitnk/goutils/encrypt"
+)
+
+// how long a /readyz result is reused, so that probes from the
+// orchestrator do not each hit the upstream
+var READY_TTL = 5 * time.Second
+var READY_TIMEOUT = 5 * time.Second
+
+var READY_MUTEX = &sync.Mutex{}
+var READY_AT time.Time
+var READY_ERR error = fmt.Errorf("upstream not probed yet")
+
+// set while a probe runs, the other requests get the last result
+var READY_PROBING bool
+
+// handleReadyz answers 200 when the upstream can be reached, and 503 with
+// the reason otherwise or while draining for shutdown.
+func handleReadyz(w http.ResponseWriter, req *http.Request) {
+	if isShuttingDown() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	READY_MUTEX.Lock()
+	probe := time.Since(READY_AT) > READY_TTL && !READY_PROBING
+	if probe {
+		READY_PROBING = true
+	}
+	err := READY_ERR
+	READY_MUTEX.Unlock()
+	if probe {
+		err = probeUpstream()
+		READY_MUTEX.Lock()
+		READY_ERR, READY_AT, READY_PROBING = err, time.Now(), false
+		READY_MUTEX.Unlock()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// probeUpstream connects to the upstream. With ReadyProbe (an HTTP
+// host:port) set, it also asks the upstream for ReadyProbe and waits for
+// a reply, which for lightsocks shows that the key works.
+func probeUpstream() error {
+	cfg := currentConfig()
+	shost, sport := "", "80"
+	if cfg.ReadyProbe != "" {
+		var err error
+		shost, sport, err = net.SplitHostPort(cfg.ReadyProbe)
+		if err != nil {
+			return fmt.Errorf("bad ReadyProbe: %v", err)
+		}
+	}
+	r := upstreamRemote(cfg, shost, sport)
+	ctx, cancel := context.WithTimeout(context.Background(), READY_TIMEOUT)
+	defer cancel()
+	remote, err := dialRemoteContext(ctx, cfg, r)
+	if err != nil {
+		return fmt.Errorf("cannot connect to upstream %s:%s: %v", r.Host, r.Port, err)
+	}
+	defer remote.Close()
+	if cfg.ReadyProbe == "" {
+		return nil
+	}
+	remote.SetDeadline(time.Now().Add(READY_TIMEOUT))
+
+	req := []byte("HEAD / HTTP/1.0\r\nHost: " + shost + "\r\n\r\n")
+	if r.Type == UPSTREAM_SOCKS5 || r.Type == UPSTREAM_HTTPCONNECT {
+		if r.Type == UPSTREAM_SOCKS5 {
+			err = socks5Handshake(remote, shost, sport, r.User, r.Pass)
+		} else {
+			err = httpConnect(remote, net.JoinHostPort(shost, sport), connectHost(r, shost, sport), connectAuth(r))
+		}
+		if err != nil {
+			return fmt.Errorf("upstream %s: %v", r.Type, err)
+		}
+		remote.Write(req)
+		_, err = io.ReadFull(remote, make([]byte, 1))
+		if err != nil {
+			return fmt.Errorf("no reply for %s: %v", cfg.ReadyProbe, err)
+		}
+		return nil
+	}
+
+	writeHandshake(connLog("readyz"), remote, shost, sport, r, "")
+	if r.Ack {
+		err = readUpstreamAck(cfg, remote)
+		if err != nil {
+			return fmt.Errorf("upstream does not speak goixy protocol: %v", err)
+		}
+		remote.SetDeadline(time.Now().Add(READY_TIMEOUT))
+	}
+	err = writeFrame(remote, req, r)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 2)
+	for {
+		_, err = io.ReadFull(remote, b)
+		if err != nil {
+			return fmt.Errorf("no reply for %s, wrong key?: %v", cfg.ReadyProbe, err)
+		}
+		// skip keepalives
+		if size := binary.BigEndian.Uint16(b); size > 0 {
+			frame := make([]byte, size)
+			_, err = io.ReadFull(remote, frame)
+			if err != nil {
+				return fmt.Errorf("truncated reply for %s: %v", cfg.ReadyProbe, err)
+			}
+			_, err = encrypt.Decrypt(frame, r.Key)
+			if err != nil {
+				return fmt.Errorf("cannot decrypt the reply, wrong key?: %v", err)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// RewriteRule is a Rewrite entry: destinations matching Match (a WhiteList
+// style pattern) are routed and dialed as Rewrite, a host:port, or a host
+// keeping the port.
+type RewriteRule struct {
+	Match   string
+	Rewrite string
+}
+
+type rewrite struct {
+	rule Rule
+	host string
+	port string
+}
+
+// DestTransform rewrites a destination before it is routed and dialed,
+// with ok false to leave it as is.
+type DestTransform func(cfg *routerConfig, shost, sport string) (host, port string, ok bool)
+
+// the transforms tried in order by getRemoteInfo; the first one to
+// rewrite a destination wins
+var DEST_TRANSFORMS = []DestTransform{rewriteByRules}
+
+func compileRewriteRules(entries []RewriteRule) ([]rewrite, error) {
+	rules := []rewrite{}
+	for _, e := range entries {
+		compiled, err := compileRules("Rewrite", []string{e.Match})
+		if err != nil {
+			return nil, err
+		}
+		host, port := e.Rewrite, ""
+		if h, p, err := net.SplitHostPort(e.Rewrite); err == nil {
+			host, port = h, p
+			nport, err := strconv.Atoi(p)
+			if err != nil || nport <= 0 || nport > 65535 {
+				return nil, fmt.Errorf("Invalid Rewrite entry %q: bad port %s", e.Match, p)
+			}
+		}
+		if host == "" {
+			return nil, fmt.Errorf("Invalid Rewrite entry %q: no host in %q", e.Match, e.Rewrite)
+		}
+		rules = append(rules, rewrite{compiled[0], host, port})
+	}
+	return rules, nil
+}
+
+// rewriteByRules is the DestTransform of the Rewrite entries.
+func rewriteByRules(cfg *routerConfig, shost, sport string) (string, string, bool) {
+	for _, rw := range cfg.rewriteRules {
+		if rw.rule.Port != "" && rw.rule.Port != sport {
+			continue
+		}
+		if rw.rule.Re.FindString(normalizeHost(shost)) == "" {
+			continue
+		}
+		port := rw.port
+		if port == "" {
+			port = sport
+		}
+		return rw.host, port, true
+	}
+	return "", "", false
+}
+
+// transformDest runs shost:sport through DEST_TRANSFORMS.
+func transformDest(cfg *routerConfig, lg connLog, shost, sport string) (string, string) {
+	for _, transform := range DEST_TRANSFORMS {
+		if host, port, ok := transform(cfg, shost, sport); ok {
+			lg.info("rewrite %s:%s to %s:%s", shost, sport, host, port)
+			return host, port
+		}
+	}
+	return shost, sport
+}
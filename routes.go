@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// printRoutes prints the loaded routing rules in the order a connection
+// is checked against them, for `goixy routes`.
+func printRoutes() {
+	cfg := currentConfig()
+	fmt.Printf("config: %s\n", configPath())
+	if len(cfg.AllowedPorts) > 0 {
+		fmt.Printf("AllowedPorts: %v, other ports refused\n", cfg.AllowedPorts)
+	}
+	printRules("BlackList (refused)", cfg.blackRules)
+	if len(cfg.rewriteRules) > 0 {
+		fmt.Printf("Rewrite (then routed as rewritten):\n")
+		for _, rw := range cfg.rewriteRules {
+			port := ""
+			if rw.rule.Port != "" {
+				port = " port " + rw.rule.Port
+			}
+			target := rw.host
+			if rw.port != "" {
+				target = net.JoinHostPort(rw.host, rw.port)
+			}
+			fmt.Printf("  %s%s -> %s\n", rw.rule.Pattern, port, target)
+		}
+	}
+	if cfg.RouteScript != "" {
+		fmt.Printf("RouteScript: %s, decides unless it fails\n", cfg.RouteScript)
+	}
+	if cfg.DirectHost != "" && (cfg.bypass.all || len(cfg.bypass.hosts) > 0 || len(cfg.bypass.nets) > 0) {
+		fmt.Printf("bypass from environment (direct):\n")
+		if cfg.bypass.all {
+			fmt.Printf("  *\n")
+		}
+		for _, h := range cfg.bypass.hosts {
+			fmt.Printf("  %s and *.%s\n", h, h)
+		}
+		for _, n := range cfg.bypass.nets {
+			fmt.Printf("  %s\n", n)
+		}
+	}
+	printRules("DirectList (direct)", cfg.directRules)
+	printRules("WhiteList (upstream)", cfg.whiteRules)
+	printRules("KeyList (upstream, own key)", cfg.keyRules)
+	if cfg.ReverseDNS {
+		fmt.Printf("ReverseDNS: IPs are matched by their PTR names against WhiteList\n")
+	}
+	upstream := fmt.Sprintf("upstream %s:%s", cfg.Host, cfg.Port)
+	if len(cfg.Upstreams) > 0 {
+		upstream = "upstream"
+		for _, s := range cfg.Upstreams {
+			upstream += fmt.Sprintf(" %s:%s(%d)", s.Host, s.Port, s.Weight)
+		}
+	}
+	direct := fmt.Sprintf("direct %s:%s", cfg.DirectHost, cfg.DirectPort)
+	switch {
+	case cfg.FailClosed:
+		fmt.Printf("otherwise: refused\n")
+	case WITH_DIRECT:
+		fmt.Printf("otherwise: %s for HTTP, %s for SOCKS\n", direct, upstream)
+	default:
+		fmt.Printf("otherwise: %s\n", upstream)
+	}
+	if len(cfg.AllowDestinations) > 0 {
+		fmt.Printf("AllowDestinations: %v, whatever the route, others refused\n", cfg.AllowDestinations)
+	}
+}
+
+func printRules(title string, rules []Rule) {
+	if len(rules) == 0 {
+		return
+	}
+	fmt.Printf("%s:\n", title)
+	for _, rule := range rules {
+		port := ""
+		if rule.Port != "" {
+			port = " port " + rule.Port
+		}
+		fmt.Printf("  %s%s\n", rule.Pattern, port)
+	}
+}
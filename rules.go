@@ -0,0 +1,195 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rule is a compiled WhiteList/BlackList entry. Key is set for KeyList
+// entries only. Hits counts the WhiteList matches, for the report.
+type Rule struct {
+	Pattern string
+	Port    string
+	Re      *regexp.Regexp
+	Key     []byte
+	Hits    *uint64
+}
+
+// KeyRule is a KeyList entry: destinations matching Pattern (a WhiteList
+// style pattern) go upstream, encrypted with Key instead of the global one.
+type KeyRule struct {
+	Pattern string
+	Key     string
+}
+
+// compileRules compiles the entries of a rule list once at load, instead
+// of for every connection.
+func compileRules(name string, entries []string) ([]Rule, error) {
+	rules := []Rule{}
+	for _, s := range entries {
+		pattern, port := splitRulePort(s)
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s entry %q: %v", name, s, err)
+		}
+		rules = append(rules, Rule{Pattern: pattern, Port: port, Re: re, Hits: new(uint64)})
+	}
+	return rules, nil
+}
+
+// a rule that matches a domain and its subdomains, as import-gfwlist
+// writes them: (^|\.)example\.com$
+var RE_DOMAIN_RULE = regexp.MustCompile(`^\(\^\|\\\.\)([a-z0-9-]+(\\\.[a-z0-9-]+)*)\$$`)
+
+// ruleDomain returns the domain of rule when it has the form of
+// RE_DOMAIN_RULE and no port, so that it can be matched by suffix.
+func ruleDomain(rule Rule) (string, bool) {
+	if rule.Port != "" {
+		return "", false
+	}
+	m := RE_DOMAIN_RULE.FindStringSubmatch(rule.Pattern)
+	if m == nil {
+		return "", false
+	}
+	return strings.Replace(m[1], `\.`, ".", -1), true
+}
+
+func compileKeyRules(entries []KeyRule) ([]Rule, error) {
+	rules := []Rule{}
+	for _, e := range entries {
+		if strings.TrimSpace(e.Key) == "" {
+			return nil, fmt.Errorf("Invalid KeyList entry %q: no Key", e.Pattern)
+		}
+		compiled, err := compileRules("KeyList", []string{e.Pattern})
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256([]byte(strings.TrimSpace(e.Key)))
+		rule := compiled[0]
+		rule.Key = sum[:]
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// readRuleFiles reads the patterns in files, one per line. Blank lines
+// and lines starting with # are skipped. Relative paths are taken from
+// dir, the directory of the config file.
+func readRuleFiles(files []string, dir string) ([]string, error) {
+	lines := []string{}
+	for _, file := range files {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+func matchRules(rules []Rule, shost, sport string) bool {
+	_, ok := firstRule(rules, shost, sport)
+	return ok
+}
+
+func firstRule(rules []Rule, shost, sport string) (Rule, bool) {
+	rule, ok, _ := firstRuleWithin(rules, shost, sport, 0)
+	return rule, ok
+}
+
+// firstRuleWithin is firstRule that gives up once matching took longer
+// than budget (0 for no limit), with complete false.
+func firstRuleWithin(rules []Rule, shost, sport string, budget time.Duration) (rule Rule, ok, complete bool) {
+	started := time.Now()
+	for _, rule := range rules {
+		if budget > 0 && time.Since(started) > budget {
+			return Rule{}, false, false
+		}
+		if rule.Port != "" && rule.Port != sport {
+			continue
+		}
+		if rule.Re.FindString(shost) != "" {
+			return rule, true, true
+		}
+	}
+	return Rule{}, false, true
+}
+
+// unmatchedRules returns the entries of rules that never matched since
+// they were loaded, likely typos or dead entries.
+func unmatchedRules(rules []Rule) []string {
+	entries := []string{}
+	for _, rule := range rules {
+		if atomic.LoadUint64(rule.Hits) > 0 {
+			continue
+		}
+		entry := rule.Pattern
+		if rule.Port != "" {
+			entry += ":" + rule.Port
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// the number of host:port routes a config remembers
+const ROUTE_CACHE_SIZE = 1024
+
+type lruEntry struct {
+	key   string
+	value string
+}
+
+type lru struct {
+	size  int
+	items map[string]*list.Element
+	order *list.List
+	mutex sync.Mutex
+}
+
+func newLRU(size int) *lru {
+	return &lru{size: size, items: map[string]*list.Element{}, order: list.New()}
+}
+
+func (c *lru) Get(key string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*lruEntry).value, true
+	}
+	return "", false
+}
+
+func (c *lru) Set(key string, value string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.items[key]; ok {
+		e.Value.(*lruEntry).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruEntry{key, value})
+	if c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*lruEntry).key)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"go.starlark.net/starlark"
+)
+
+const ROUTE_UPSTREAM = "upstream"
+const ROUTE_DIRECT = "direct"
+const ROUTE_BLOCK = "block"
+
+// loadRouteScript runs the Starlark file once and returns its route
+// function, or nil if file is "". Its globals are frozen so calls can run
+// concurrently.
+func loadRouteScript(file string) (starlark.Value, error) {
+	if file == "" {
+		return nil, nil
+	}
+	thread := &starlark.Thread{Name: "load"}
+	globals, err := starlark.ExecFile(thread, file, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid RouteScript: %v", err)
+	}
+	globals.Freeze()
+	fn, ok := globals["route"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("Invalid RouteScript: %s does not define route()", file)
+	}
+	return fn, nil
+}
+
+// routeByScript returns ROUTE_UPSTREAM, ROUTE_DIRECT or ROUTE_BLOCK as
+// decided by the script, or "" if it failed.
+func routeByScript(cfg *routerConfig, shost, sport, client_ip string) string {
+	nport, _ := strconv.Atoi(sport)
+	thread := &starlark.Thread{Name: shost}
+	args := starlark.Tuple{
+		starlark.String(shost),
+		starlark.MakeInt(nport),
+		starlark.String(client_ip),
+	}
+	v, err := starlark.Call(thread, cfg.routeScript, args, nil)
+	if err != nil {
+		warn("RouteScript failed for %s:%s: %v", shost, sport, err)
+		return ""
+	}
+	route, ok := starlark.AsString(v)
+	if !ok || (route != ROUTE_UPSTREAM && route != ROUTE_DIRECT && route != ROUTE_BLOCK) {
+		warn("RouteScript returned bad route for %s:%s: %v", shost, sport, v)
+		return ""
+	}
+	debug("RouteScript: %s:%s from %s is %s", shost, sport, client_ip, route)
+	return route
+}
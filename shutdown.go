@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var CLIENTS = map[net.Conn]bool{}
+var CLIENTS_WG = &sync.WaitGroup{}
+var SHUTTING_DOWN = false
+
+func trackClient(client net.Conn) {
+	MUTEX.Lock()
+	CLIENTS[client] = true
+	MUTEX.Unlock()
+}
+
+func untrackClient(client net.Conn) {
+	MUTEX.Lock()
+	delete(CLIENTS, client)
+	MUTEX.Unlock()
+	CLIENTS_WG.Done()
+}
+
+func isShuttingDown() bool {
+	MUTEX.Lock()
+	defer MUTEX.Unlock()
+	return SHUTTING_DOWN
+}
+
+// handleSignals closes the listeners on SIGINT/SIGTERM so that main stops
+// accepting and starts draining, the main one last. A second signal exits
+// immediately.
+func handleSignals(listeners []net.Listener) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	<-ch
+	MUTEX.Lock()
+	SHUTTING_DOWN = true
+	MUTEX.Unlock()
+	info("shutting down, waiting for %d connections", atomic.LoadInt64(&COUNT_CONNECTED))
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	<-ch
+	info("got second signal, exit now")
+	os.Exit(1)
+}
+
+// drainClients waits for active connections to finish. With a positive
+// grace (in seconds), connections still open after it are force-closed.
+func drainClients(grace int64) {
+	done := make(chan bool)
+	go func() {
+		CLIENTS_WG.Wait()
+		close(done)
+	}()
+	var ch_grace <-chan time.Time
+	if grace > 0 {
+		ch_grace = time.After(time.Second * time.Duration(grace))
+	}
+	select {
+	case <-done:
+		return
+	case <-ch_grace:
+	}
+
+	MUTEX.Lock()
+	n := len(CLIENTS)
+	for client := range CLIENTS {
+		client.Close()
+	}
+	MUTEX.Unlock()
+	info("shutdown grace exceeded, force closed %d connections", n)
+	<-done
+}
+
+// handleReload reloads the config on SIGHUP.
+func handleReload() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		reloadRouterConfig()
+	}
+}
@@ -0,0 +1,4 @@
+package main
+
+// there is no SIGUSR2 on Windows
+func handleLogLevelSignal() {}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// how long to wait for the client to start a TLS handshake in a tunnel
+var SNI_PEEK_TIMEOUT = time.Second
+
+// peekClientHello reads the first TLS record the client sends in a CONNECT
+// tunnel. Whatever was read is returned, TLS or not, so the caller can
+// forward it to the remote unchanged.
+func peekClientHello(client net.Conn) []byte {
+	client.SetReadDeadline(time.Now().Add(SNI_PEEK_TIMEOUT))
+	defer client.SetReadDeadline(time.Time{})
+
+	header := make([]byte, 5)
+	n, err := io.ReadFull(client, header)
+	if err != nil || header[0] != 0x16 {
+		return header[:n]
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[3:5]))
+	n, _ = io.ReadFull(client, body)
+	return append(header, body[:n]...)
+}
+
+// parseSNI returns the server_name from a TLS ClientHello record, or ""
+// if data is not a (complete enough) ClientHello.
+func parseSNI(data []byte) string {
+	// record header, then handshake type 1 (client_hello) and length
+	if len(data) < 9 || data[0] != 0x16 || data[5] != 1 {
+		return ""
+	}
+	p := data[9:]
+	// client_version and random
+	if len(p) < 34 {
+		return ""
+	}
+	p = p[34:]
+	// session_id
+	if len(p) < 1 || len(p) < 1+int(p[0]) {
+		return ""
+	}
+	p = p[1+int(p[0]):]
+	// cipher_suites
+	if len(p) < 2 {
+		return ""
+	}
+	n := int(binary.BigEndian.Uint16(p))
+	if len(p) < 2+n {
+		return ""
+	}
+	p = p[2+n:]
+	// compression_methods
+	if len(p) < 1 || len(p) < 1+int(p[0]) {
+		return ""
+	}
+	p = p[1+int(p[0]):]
+	// extensions
+	if len(p) < 2 {
+		return ""
+	}
+	n = int(binary.BigEndian.Uint16(p))
+	p = p[2:]
+	if len(p) > n {
+		p = p[:n]
+	}
+	for len(p) >= 4 {
+		typ := binary.BigEndian.Uint16(p)
+		n = int(binary.BigEndian.Uint16(p[2:]))
+		p = p[4:]
+		if len(p) < n {
+			return ""
+		}
+		if typ == 0 {
+			return parseServerNameExt(p[:n])
+		}
+		p = p[n:]
+	}
+	return ""
+}
+
+func parseServerNameExt(p []byte) string {
+	if len(p) < 2 {
+		return ""
+	}
+	p = p[2:]
+	for len(p) >= 3 {
+		typ := p[0]
+		n := int(binary.BigEndian.Uint16(p[1:]))
+		p = p[3:]
+		if len(p) < n {
+			return ""
+		}
+		if typ == 0 {
+			return string(p[:n])
+		}
+		p = p[n:]
+	}
+	return ""
+}
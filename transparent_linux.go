@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// SO_ORIGINAL_DST of netfilter, for both SOL_IP and SOL_IPV6
+const SO_ORIGINAL_DST = 80
+
+// originalDst returns the destination of a connection redirected to goixy
+// by iptables (REDIRECT or DNAT), from SO_ORIGINAL_DST.
+func originalDst(conn net.Conn) (string, string, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", "", errors.New("not a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return "", "", err
+	}
+	var host, port string
+	var serr error
+	isV4 := tc.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	err = raw.Control(func(fd uintptr) {
+		if isV4 {
+			// the sockaddr_in fills the first bytes of an IPv6Mreq
+			mreq, e := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, SO_ORIGINAL_DST)
+			if e != nil {
+				serr = e
+				return
+			}
+			a := mreq.Multiaddr
+			host = net.IP(a[4:8]).String()
+			port = strconv.Itoa(int(binary.BigEndian.Uint16(a[2:4])))
+			return
+		}
+		// and a sockaddr_in6 the first bytes of an IPv6MTUInfo
+		info, e := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, SO_ORIGINAL_DST)
+		if e != nil {
+			serr = e
+			return
+		}
+		host = net.IP(info.Addr.Addr[:]).String()
+		// Port is in network byte order in memory
+		b := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		port = strconv.Itoa(int(binary.BigEndian.Uint16(b[:])))
+	})
+	if err == nil {
+		err = serr
+	}
+	return host, port, err
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func originalDst(conn net.Conn) (string, string, error) {
+	return "", "", errors.New("transparent proxying needs Linux")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"golang.org/x/net/proxy"
+)
+
+// dialRemote connects to the remote of r (or to r.Front for domain
+// fronting), over KCP when r.Transport is kcp, through UpstreamProxy when
+// r.UseProxy is set, and wraps the connection in TLS when r.TLS is set.
+// The goixy frames are then carried inside TLS as is.
+func dialRemote(cfg *routerConfig, r Remote) (net.Conn, error) {
+	return dialRemoteContext(context.Background(), cfg, r)
+}
+
+// dialRemoteContext is dialRemote giving up when ctx is done, for the
+// connect and the TLS handshake. A KCP dial does not wait for the remote,
+// and an UpstreamProxy that cannot take a context is dialed without it.
+func dialRemoteContext(ctx context.Context, cfg *routerConfig, r Remote) (net.Conn, error) {
+	var remote net.Conn
+	var err error
+	host := r.Host
+	if r.Front != "" {
+		host = r.Front
+	}
+	if r.Transport == TRANSPORT_KCP {
+		remote, err = dialKCP(cfg, host+":"+r.Port)
+	} else if r.UseProxy {
+		if d, ok := cfg.upstreamDialer.(proxy.ContextDialer); ok {
+			remote, err = d.DialContext(ctx, "tcp", host+":"+r.Port)
+		} else {
+			remote, err = cfg.upstreamDialer.Dial("tcp", host+":"+r.Port)
+		}
+	} else {
+		remote, err = cfg.localDialer.DialContext(ctx, "tcp", host+":"+r.Port)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !r.TLS {
+		return remote, nil
+	}
+	name := r.TLSName
+	if name == "" {
+		name = r.Host
+	}
+	config := &tls.Config{
+		ServerName:         name,
+		InsecureSkipVerify: r.TLSInsecure,
+	}
+	if r.TLSPin != nil {
+		// the pin replaces the CA store
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = r.TLSPin.verify
+	}
+	conn := tls.Client(remote, config)
+	err = conn.HandshakeContext(ctx)
+	if err != nil {
+		remote.Close()
+		return nil, fmt.Errorf("tls handshake: %v", err)
+	}
+	return conn, nil
+}
+
+// connectHost is the Host header of the CONNECT to an httpconnect
+// upstream: the upstream itself when fronted (through FrontDomain, or a
+// TLS name that is not Host), so the front passes the request on to it,
+// or else the target.
+func connectHost(r Remote, shost, sport string) string {
+	if r.Front != "" || (r.TLSName != "" && r.TLSName != r.Host) {
+		return net.JoinHostPort(r.Host, r.Port)
+	}
+	return net.JoinHostPort(shost, sport)
+}
+
+func connectAuth(r Remote) string {
+	if r.User == "" {
+		return ""
+	}
+	return basicAuth(r.User, r.Pass)
+}
+
+// UpstreamReplyError is a CONNECT refused by the upstream SOCKS5 proxy,
+// e.g. with 4 (host unreachable) when it could not resolve the host.
+type UpstreamReplyError struct {
+	Rep byte
+}
+
+func (e *UpstreamReplyError) Error() string {
+	return fmt.Sprintf("connect refused with reply code %v", e.Rep)
+}
+
+// socks5Handshake negotiates a CONNECT to shost:sport on an upstream plain
+// SOCKS5 proxy, authenticating with user/pass (RFC 1929) when user is set.
+func socks5Handshake(conn net.Conn, shost, sport, user, pass string) error {
+	if user != "" {
+		conn.Write([]byte{5, 2, 0, 2})
+	} else {
+		conn.Write([]byte{5, 1, 0})
+	}
+	buffer := make([]byte, 2)
+	_, err := io.ReadFull(conn, buffer)
+	if err != nil {
+		return fmt.Errorf("cannot read method selection: %v", err)
+	}
+	if buffer[0] != 5 {
+		return fmt.Errorf("bad version in method selection: %v", buffer[0])
+	}
+	switch buffer[1] {
+	case 0:
+	case 2:
+		if user == "" {
+			return errors.New("upstream requires username/password auth")
+		}
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("username or password too long")
+		}
+		req := []byte{1, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		conn.Write(req)
+		_, err = io.ReadFull(conn, buffer)
+		if err != nil {
+			return fmt.Errorf("cannot read auth status: %v", err)
+		}
+		if buffer[1] != 0 {
+			return errors.New("upstream rejected the credentials")
+		}
+	default:
+		return fmt.Errorf("no acceptable auth method (got %v)", buffer[1])
+	}
+
+	nport, err := strconv.Atoi(sport)
+	if err != nil {
+		return fmt.Errorf("bad port: %s", sport)
+	}
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(shost); ip != nil && ip.To4() != nil {
+		req = append(req, ATYP_IPV4)
+		req = append(req, ip.To4()...)
+	} else if ip != nil {
+		req = append(req, ATYP_IPV6)
+		req = append(req, ip.To16()...)
+	} else {
+		if len(shost) > 255 {
+			return fmt.Errorf("host name too long: %s", shost)
+		}
+		req = append(req, ATYP_DOMAIN, byte(len(shost)))
+		req = append(req, shost...)
+	}
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(nport))
+	req = append(req, b...)
+	conn.Write(req)
+
+	buffer = make([]byte, 4)
+	_, err = io.ReadFull(conn, buffer)
+	if err != nil {
+		return fmt.Errorf("cannot read connect reply: %v", err)
+	}
+	if buffer[1] != 0 {
+		return &UpstreamReplyError{buffer[1]}
+	}
+	size := 0
+	switch buffer[3] {
+	case ATYP_IPV4:
+		size = 4
+	case ATYP_IPV6:
+		size = 16
+	case ATYP_DOMAIN:
+		_, err = io.ReadFull(conn, buffer[:1])
+		if err != nil {
+			return fmt.Errorf("cannot read bound address: %v", err)
+		}
+		size = int(buffer[0])
+	default:
+		return fmt.Errorf("bad atyp in connect reply: %v", buffer[3])
+	}
+	// skip BND.ADDR and BND.PORT
+	_, err = io.ReadFull(conn, make([]byte, size+2))
+	if err != nil {
+		return fmt.Errorf("cannot read bound address: %v", err)
+	}
+	return nil
+}
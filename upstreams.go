@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// UpstreamServer is an Upstreams entry. All entries share the other
+// Upstream* settings and Key, and new connections are spread over them in
+// proportion to Weight (default 1). Metered counts its traffic as metered.
+type UpstreamServer struct {
+	Host    string
+	Port    string
+	Weight  int
+	Metered bool
+}
+
+// defaults of UpstreamFailures and UpstreamCooldown (seconds)
+var UPSTREAM_FAILURES = 3
+var UPSTREAM_COOLDOWN = int64(30)
+
+// how often the Upstreams are probed with "UpstreamSelect": "latency"
+var UPSTREAM_PROBE_INTERVAL = 30 * time.Second
+
+const UPSTREAM_SELECT_WEIGHT = "weight"
+const UPSTREAM_SELECT_LATENCY = "latency"
+
+var UPSTREAMS_MUTEX = &sync.Mutex{}
+
+// breaker is the circuit breaker of an upstream. It is closed while the
+// upstream connects, and opens after UpstreamFailures failures in a row:
+// the upstream is then skipped for UpstreamCooldown seconds. After that
+// it is half-open, and one trial connection decides whether it closes
+// again or stays open for another cooldown.
+type breaker struct {
+	failures  int
+	openUntil time.Time
+	trial     time.Time
+}
+
+// the breakers by host:port, a missing one is closed
+var UPSTREAMS_BREAKERS = map[string]*breaker{}
+
+// smoothed connect time of each upstream, by host:port
+var UPSTREAMS_RTT = map[string]time.Duration{}
+
+// checkUpstreams validates Upstreams and fills in the default weights.
+func checkUpstreams(servers []UpstreamServer) error {
+	for i := range servers {
+		s := &servers[i]
+		if s.Host == "" || s.Port == "" {
+			return fmt.Errorf("Invalid Upstreams entry %d: Host and Port are required", i)
+		}
+		if s.Weight < 0 {
+			return fmt.Errorf("Invalid Upstreams entry %s:%s: negative Weight", s.Host, s.Port)
+		}
+		if s.Weight == 0 {
+			s.Weight = 1
+		}
+	}
+	return nil
+}
+
+func upstreamFailures(cfg *routerConfig) int {
+	if cfg.UpstreamFailures > 0 {
+		return cfg.UpstreamFailures
+	}
+	return UPSTREAM_FAILURES
+}
+
+func upstreamCooldown(cfg *routerConfig) time.Duration {
+	if cfg.UpstreamCooldown > 0 {
+		return time.Second * time.Duration(cfg.UpstreamCooldown)
+	}
+	return time.Second * time.Duration(UPSTREAM_COOLDOWN)
+}
+
+// breakerOpen tells if the breaker of key skips its upstream at now: it
+// is open, or half-open with a trial connection in flight.
+func breakerOpen(cfg *routerConfig, key string, now time.Time) bool {
+	b := UPSTREAMS_BREAKERS[key]
+	if b == nil || b.failures < upstreamFailures(cfg) {
+		return false
+	}
+	if now.Before(b.openUntil) {
+		return true
+	}
+	// a trial that did not report within a cooldown is taken as lost
+	return now.Before(b.trial.Add(upstreamCooldown(cfg)))
+}
+
+// pickUpstream returns the server for a new upstream connection:
+// Host:Port, or of the Upstreams whose breaker is not open the fastest
+// one with "UpstreamSelect": "latency", else a weighted random pick. If
+// all of them are open, the pick is among all, and handleRemote fails it
+// without connecting.
+func pickUpstream(cfg *routerConfig) UpstreamServer {
+	if len(cfg.Upstreams) == 0 {
+		return UpstreamServer{Host: cfg.Host, Port: cfg.Port, Metered: cfg.UpstreamMetered}
+	}
+	healthy := []UpstreamServer{}
+	now := time.Now()
+	UPSTREAMS_MUTEX.Lock()
+	for _, s := range cfg.Upstreams {
+		if !breakerOpen(cfg, net.JoinHostPort(s.Host, s.Port), now) {
+			healthy = append(healthy, s)
+		}
+	}
+	UPSTREAMS_MUTEX.Unlock()
+	if len(healthy) == 0 {
+		healthy = cfg.Upstreams
+	}
+	if cfg.UpstreamSelect == UPSTREAM_SELECT_LATENCY {
+		if s, ok := fastestUpstream(healthy); ok {
+			return s
+		}
+		// nothing measured yet
+	}
+	total := 0
+	for _, s := range healthy {
+		total += s.Weight
+	}
+	n := rand.Intn(total)
+	for _, s := range healthy {
+		if n < s.Weight {
+			return s
+		}
+		n -= s.Weight
+	}
+	return healthy[0]
+}
+
+// upstreamAttempt is asked before connecting to host:port. It returns
+// false while its breaker is open, so the connection fails at once
+// instead of waiting for the connect to time out. When the breaker is
+// half-open, the caller gets to make the trial connection.
+func upstreamAttempt(cfg *routerConfig, host, port string) bool {
+	key := net.JoinHostPort(host, port)
+	now := time.Now()
+	UPSTREAMS_MUTEX.Lock()
+	defer UPSTREAMS_MUTEX.Unlock()
+	if breakerOpen(cfg, key, now) {
+		return false
+	}
+	if b := UPSTREAMS_BREAKERS[key]; b != nil && b.failures >= upstreamFailures(cfg) {
+		b.trial = now
+	}
+	return true
+}
+
+// markUpstreamDown counts a failure to connect to host:port, and opens
+// its breaker at UpstreamFailures in a row or when the trial failed.
+func markUpstreamDown(cfg *routerConfig, host, port string) {
+	key := net.JoinHostPort(host, port)
+	UPSTREAMS_MUTEX.Lock()
+	defer UPSTREAMS_MUTEX.Unlock()
+	b := UPSTREAMS_BREAKERS[key]
+	if b == nil {
+		b = &breaker{}
+		UPSTREAMS_BREAKERS[key] = b
+	}
+	b.failures += 1
+	b.trial = time.Time{}
+	if b.failures >= upstreamFailures(cfg) {
+		b.openUntil = time.Now().Add(upstreamCooldown(cfg))
+		warn("upstream %s failed %d times in a row, skip it for %v", key, b.failures, upstreamCooldown(cfg))
+	}
+}
+
+// markUpstreamUp closes the breaker of host:port once it connected.
+func markUpstreamUp(cfg *routerConfig, host, port string) {
+	key := net.JoinHostPort(host, port)
+	UPSTREAMS_MUTEX.Lock()
+	defer UPSTREAMS_MUTEX.Unlock()
+	b := UPSTREAMS_BREAKERS[key]
+	if b == nil {
+		return
+	}
+	if b.failures >= upstreamFailures(cfg) {
+		info("upstream %s is back", key)
+	}
+	delete(UPSTREAMS_BREAKERS, key)
+}
+
+// fastestUpstream returns the one of servers with the lowest smoothed
+// connect time, ok false when none was measured.
+func fastestUpstream(servers []UpstreamServer) (UpstreamServer, bool) {
+	UPSTREAMS_MUTEX.Lock()
+	defer UPSTREAMS_MUTEX.Unlock()
+	var best UpstreamServer
+	var bestRTT time.Duration
+	for _, s := range servers {
+		rtt, ok := UPSTREAMS_RTT[net.JoinHostPort(s.Host, s.Port)]
+		if ok && (bestRTT == 0 || rtt < bestRTT) {
+			best, bestRTT = s, rtt
+		}
+	}
+	return best, bestRTT > 0
+}
+
+// probeUpstreams measures the connect time (including TLS) of each of
+// Upstreams every UPSTREAM_PROBE_INTERVAL while "UpstreamSelect" is
+// "latency", smoothed so that one slow connect does not flip the choice.
+// A server that cannot be reached counts as a failure for its breaker.
+func probeUpstreams() {
+	for {
+		cfg := currentConfig()
+		if cfg.UpstreamSelect == UPSTREAM_SELECT_LATENCY {
+			for _, s := range cfg.Upstreams {
+				probeUpstreamRTT(cfg, s)
+			}
+		}
+		time.Sleep(UPSTREAM_PROBE_INTERVAL)
+	}
+}
+
+// probeUpstreamRTT measures s itself, not a pickUpstream choice or the
+// FrontDomain in front of it.
+func probeUpstreamRTT(cfg *routerConfig, s UpstreamServer) {
+	r := serverRemote(cfg, s, cfg.key)
+	started := time.Now()
+	conn, err := dialRemote(cfg, r)
+	if err != nil {
+		debug("probe upstream %s:%s: %v", s.Host, s.Port, err)
+		markUpstreamDown(cfg, s.Host, s.Port)
+		return
+	}
+	rtt := time.Since(started)
+	conn.Close()
+	markUpstreamUp(cfg, s.Host, s.Port)
+
+	key := net.JoinHostPort(s.Host, s.Port)
+	UPSTREAMS_MUTEX.Lock()
+	if old, ok := UPSTREAMS_RTT[key]; ok {
+		rtt = (old*4 + rtt) / 5
+	}
+	UPSTREAMS_RTT[key] = rtt
+	UPSTREAMS_MUTEX.Unlock()
+	verbose("probe upstream %s:%s: %v", s.Host, s.Port, rtt)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const EVENT_OPEN = "open"
+const EVENT_CLOSE = "close"
+
+// WebhookEvent is POSTed as JSON to WebhookURL when a connection to a
+// remote opens or closes. Bytes and duration are set on close only.
+type WebhookEvent struct {
+	Event     string  `json:"event"`
+	Host      string  `json:"host"`
+	Port      string  `json:"port"`
+	Route     string  `json:"route"`
+	Client    string  `json:"client"`
+	BytesUp   int64   `json:"bytes_up"`
+	BytesDown int64   `json:"bytes_down"`
+	Duration  float64 `json:"duration"`
+}
+
+var WEBHOOK_QUEUE = make(chan WebhookEvent, 256)
+var WEBHOOK_WORKERS = 2
+var WEBHOOK_CLIENT = &http.Client{Timeout: 5 * time.Second}
+
+func startWebhooks() {
+	for i := 0; i < WEBHOOK_WORKERS; i++ {
+		go webhookWorker()
+	}
+}
+
+// sendWebhook queues ev for the workers. It never blocks: when the queue
+// is full because the webhook is slow, the event is dropped.
+func sendWebhook(cfg *routerConfig, ev WebhookEvent) {
+	if cfg.WebhookURL == "" {
+		return
+	}
+	select {
+	case WEBHOOK_QUEUE <- ev:
+	default:
+		debug("webhook queue full, drop %s event for %s:%s", ev.Event, ev.Host, ev.Port)
+	}
+}
+
+func webhookWorker() {
+	for ev := range WEBHOOK_QUEUE {
+		url := currentConfig().WebhookURL
+		if url == "" {
+			continue
+		}
+		body, _ := json.Marshal(ev)
+		resp, err := WEBHOOK_CLIENT.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			debug("webhook: %v", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			debug("webhook: %s", resp.Status)
+		}
+	}
+}